@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -29,9 +30,58 @@ func Execute() {
 
 func init() {
 	var (
-		metricsPort   int
-		maxmindDBPath string
-		logLevel      string
+		metricsPort              int
+		maxmindDBPath            string
+		crawlerIPPageSize        int
+		maxmindASNDBPath         string
+		maxmindCityDBPath        string
+		geoJSONCellSize          float64
+		maxmindDBRefreshInterval time.Duration
+		crawlerASNLimit          int
+		hostingASNs              []int
+		logLevel                 string
+
+		filesystemRefreshInterval time.Duration
+		fileWatchInterval         time.Duration
+
+		logTail     bool
+		logTailPath string
+
+		slowLookupThreshold time.Duration
+		slowLookupWindow    int
+		slowLookupLogSize   int
+
+		poolStateInterval        time.Duration
+		harvesterSummaryInterval time.Duration
+
+		blockReward uint64
+
+		feeEstimateInterval    time.Duration
+		feeEstimateCosts       []int
+		feeEstimateTargetTimes []int
+
+		peerMetrics      string
+		peerMetricsLimit int
+
+		mempoolRefreshInterval time.Duration
+
+		walletTransactionInterval    time.Duration
+		walletStuckTransactionBlocks int
+		assetNames                   map[string]string
+
+		walletKeyInterval    time.Duration
+		walletKeySwitching   bool
+		walletFingerprints   []string
+		walletKeySyncTimeout time.Duration
+
+		watchAddressInterval time.Duration
+
+		walletCoinInterval      time.Duration
+		walletDustThreshold     uint64
+		walletCATDustThresholds map[string]string
+		walletMaxSendQuantity   int
+
+		requestMinIntervals map[string]string
 	)
 
 	cobra.OnInitialize(initConfig)
@@ -39,7 +89,45 @@ func init() {
 
 	rootCmd.PersistentFlags().IntVar(&metricsPort, "metrics-port", 9914, "The port the metrics server binds to")
 	rootCmd.PersistentFlags().StringVar(&maxmindDBPath, "maxmind-db-path", "", "Path to the maxmind database file")
+	rootCmd.PersistentFlags().StringVar(&maxmindASNDBPath, "maxmind-asn-db-path", "", "Path to the maxmind ASN database file")
+	rootCmd.PersistentFlags().StringVar(&maxmindCityDBPath, "maxmind-city-db-path", "", "Path to the maxmind city database file")
+	rootCmd.PersistentFlags().Float64Var(&geoJSONCellSize, "geojson-cell-size", 1, "Size, in degrees, of the grid cells peers are grouped into for the peer map")
+	rootCmd.PersistentFlags().DurationVar(&maxmindDBRefreshInterval, "maxmind-db-refresh-interval", time.Minute, "How often to check the maxmind database files for changes. Changed databases are loaded without restarting. Set to 0 to disable")
+	rootCmd.PersistentFlags().IntVar(&crawlerASNLimit, "crawler-asn-limit", 20, "Maximum number of autonomous systems to export peer counts for. Remaining peers are combined into an \"other\" series. Set to 0 for no limit")
+	rootCmd.PersistentFlags().IntSliceVar(&hostingASNs, "hosting-asns", []int{}, "Autonomous system numbers of hosting and cloud providers, for the hosting vs residential split of crawled peers. Defaults to a list of large cloud providers")
+	rootCmd.PersistentFlags().IntVar(&crawlerIPPageSize, "crawler-ip-page-size", 10000, "Number of IPs to request from the crawler at a time for country mapping. Set to 0 to request all IPs at once")
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "How verbose the logs should be. panic, fatal, error, warn, info, debug, trace")
+	rootCmd.PersistentFlags().DurationVar(&filesystemRefreshInterval, "filesystem-refresh-interval", 60*time.Second, "How often to check capacity of the filesystems used for plots and the full node database. Set to 0 to disable")
+	rootCmd.PersistentFlags().DurationVar(&fileWatchInterval, "file-watch-interval", 30*time.Second, "How often to check the size of the full node database files and any paths in file-watch, unless they set their own interval. Set to 0 to disable")
+
+	rootCmd.PersistentFlags().BoolVar(&logTail, "log-tail", false, "Follow the STAI log file to export metrics parsed from log lines")
+	rootCmd.PersistentFlags().StringVar(&logTailPath, "log-tail-path", "", "Path to the STAI log file to follow. Defaults to logging.log_filename from the STAI config")
+
+	rootCmd.PersistentFlags().DurationVar(&slowLookupThreshold, "harvester-slow-lookup-threshold", 5*time.Second, "Harvester lookups that take longer than this are counted as slow")
+	rootCmd.PersistentFlags().IntVar(&slowLookupWindow, "harvester-slow-lookup-window", 64, "Number of recent signage points used to calculate the percentage of slow harvester lookups")
+	rootCmd.PersistentFlags().IntVar(&slowLookupLogSize, "harvester-slow-lookup-log-size", 50, "Number of recent slow harvester lookups to keep for the /harvester/slow-lookups endpoint")
+	rootCmd.PersistentFlags().DurationVar(&poolStateInterval, "farmer-pool-state-interval", 60*time.Second, "How often to ask the farmer for pool state. Set to 0 to disable")
+	rootCmd.PersistentFlags().DurationVar(&harvesterSummaryInterval, "farmer-harvester-summary-interval", 60*time.Second, "How often to ask the farmer for a summary of connected harvesters. Set to 0 to disable")
+	rootCmd.PersistentFlags().Uint64Var(&blockReward, "block-reward", 2000000000000, "Total reward for a block (farmer and pool rewards), in mojos. Used to estimate expected rewards per day")
+	rootCmd.PersistentFlags().DurationVar(&feeEstimateInterval, "fee-estimate-interval", 60*time.Second, "How often to ask the full node for fee estimates. Set to 0 to disable")
+	rootCmd.PersistentFlags().IntSliceVar(&feeEstimateCosts, "fee-estimate-costs", []int{5000000, 20000000, 60000000}, "Transaction costs to estimate fees for")
+	rootCmd.PersistentFlags().IntSliceVar(&feeEstimateTargetTimes, "fee-estimate-target-times", []int{60, 120, 300}, "Target times, in seconds, to estimate fees for")
+	rootCmd.PersistentFlags().DurationVar(&mempoolRefreshInterval, "mempool-refresh-interval", 60*time.Second, "How often to fetch all items in the mempool from the full node. Fetches are delayed further when the mempool is slow to fetch. Set to 0 to disable")
+	rootCmd.PersistentFlags().DurationVar(&walletTransactionInterval, "wallet-transaction-interval", 60*time.Second, "How often to ask the wallet for pending transactions. Set to 0 to disable")
+	rootCmd.PersistentFlags().IntVar(&walletStuckTransactionBlocks, "wallet-stuck-transaction-blocks", 32, "Number of blocks after which a pending wallet transaction is considered stuck")
+	rootCmd.PersistentFlags().StringToStringVar(&assetNames, "asset-names", map[string]string{}, "Names to use for CAT asset ids, as asset_id=name. Overrides the wallet name")
+	rootCmd.PersistentFlags().DurationVar(&walletKeyInterval, "wallet-key-interval", time.Hour, "How often to report balances for the keys in wallet-keys, and in wallet-fingerprints when wallet-key-switching is enabled. Set to 0 to disable")
+	rootCmd.PersistentFlags().BoolVar(&walletKeySwitching, "wallet-key-switching", false, "UNSAFE: Log the wallet in to each key in wallet-fingerprints in turn to report its balances, then back in to the original key. This changes the active key for every other client of the wallet while it runs")
+	rootCmd.PersistentFlags().StringSliceVar(&walletFingerprints, "wallet-fingerprints", []string{}, "Fingerprints of additional keys to log the wallet in to when wallet-key-switching is enabled, or \"all\" for every key")
+	rootCmd.PersistentFlags().DurationVar(&walletKeySyncTimeout, "wallet-key-sync-timeout", 10*time.Minute, "How long to wait for the wallet to sync after logging in to each key in wallet-fingerprints")
+	rootCmd.PersistentFlags().DurationVar(&walletCoinInterval, "wallet-coin-interval", 10*time.Minute, "How often to ask the wallet for the spendable coins in each STAI and CAT wallet. Set to 0 to disable")
+	rootCmd.PersistentFlags().Uint64Var(&walletDustThreshold, "wallet-dust-threshold", 1000000, "STAI coins smaller than this amount, in mojos, are counted as dust")
+	rootCmd.PersistentFlags().StringToStringVar(&walletCATDustThresholds, "wallet-cat-dust-thresholds", map[string]string{}, "CAT coins smaller than this amount, in mojos of the CAT, are counted as dust, as asset_id=mojos. Dust is not counted for CATs without a threshold")
+	rootCmd.PersistentFlags().IntVar(&walletMaxSendQuantity, "wallet-max-send-quantity", 500, "Maximum number of coins the wallet spends in one transaction. Should match max_send_quantity in the wallet config")
+	rootCmd.PersistentFlags().StringToStringVar(&requestMinIntervals, "request-min-intervals", map[string]string{}, "Minimum time between identical requests sent in response to events, as command=duration. Defaults are get_sync_status=5s, get_wallet_balance=5s, get_connections=15s, and get_block_count_metrics=60s. Set to 0 to send every request")
+	rootCmd.PersistentFlags().DurationVar(&watchAddressInterval, "watch-address-interval", 5*time.Minute, "How often to ask the full node for the coins of each address in watch-addresses. Set to 0 to disable")
+	rootCmd.PersistentFlags().StringVar(&peerMetrics, "full-node-peer-metrics", "off", "Export metrics for each full node peer. off, ip (one series per peer), subnet (grouped by /24 or /48 subnet)")
+	rootCmd.PersistentFlags().IntVar(&peerMetricsLimit, "full-node-peer-metrics-limit", 50, "Maximum number of peer series to export. Remaining peers are combined into an \"other\" series. Set to 0 for no limit")
 
 	err := viper.BindPFlag("metrics-port", rootCmd.PersistentFlags().Lookup("metrics-port"))
 	if err != nil {
@@ -49,10 +137,154 @@ func init() {
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
+	err = viper.BindPFlag("crawler-ip-page-size", rootCmd.PersistentFlags().Lookup("crawler-ip-page-size"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("maxmind-asn-db-path", rootCmd.PersistentFlags().Lookup("maxmind-asn-db-path"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("maxmind-city-db-path", rootCmd.PersistentFlags().Lookup("maxmind-city-db-path"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("geojson-cell-size", rootCmd.PersistentFlags().Lookup("geojson-cell-size"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("maxmind-db-refresh-interval", rootCmd.PersistentFlags().Lookup("maxmind-db-refresh-interval"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("crawler-asn-limit", rootCmd.PersistentFlags().Lookup("crawler-asn-limit"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("hosting-asns", rootCmd.PersistentFlags().Lookup("hosting-asns"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
 	err = viper.BindPFlag("log-level", rootCmd.PersistentFlags().Lookup("log-level"))
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
+	err = viper.BindPFlag("filesystem-refresh-interval", rootCmd.PersistentFlags().Lookup("filesystem-refresh-interval"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("file-watch-interval", rootCmd.PersistentFlags().Lookup("file-watch-interval"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("log-tail", rootCmd.PersistentFlags().Lookup("log-tail"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("log-tail-path", rootCmd.PersistentFlags().Lookup("log-tail-path"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("harvester-slow-lookup-threshold", rootCmd.PersistentFlags().Lookup("harvester-slow-lookup-threshold"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("harvester-slow-lookup-window", rootCmd.PersistentFlags().Lookup("harvester-slow-lookup-window"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("harvester-slow-lookup-log-size", rootCmd.PersistentFlags().Lookup("harvester-slow-lookup-log-size"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("farmer-pool-state-interval", rootCmd.PersistentFlags().Lookup("farmer-pool-state-interval"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("farmer-harvester-summary-interval", rootCmd.PersistentFlags().Lookup("farmer-harvester-summary-interval"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("block-reward", rootCmd.PersistentFlags().Lookup("block-reward"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("fee-estimate-interval", rootCmd.PersistentFlags().Lookup("fee-estimate-interval"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("fee-estimate-costs", rootCmd.PersistentFlags().Lookup("fee-estimate-costs"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("fee-estimate-target-times", rootCmd.PersistentFlags().Lookup("fee-estimate-target-times"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("mempool-refresh-interval", rootCmd.PersistentFlags().Lookup("mempool-refresh-interval"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("wallet-transaction-interval", rootCmd.PersistentFlags().Lookup("wallet-transaction-interval"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("wallet-stuck-transaction-blocks", rootCmd.PersistentFlags().Lookup("wallet-stuck-transaction-blocks"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("asset-names", rootCmd.PersistentFlags().Lookup("asset-names"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("wallet-key-interval", rootCmd.PersistentFlags().Lookup("wallet-key-interval"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("wallet-key-switching", rootCmd.PersistentFlags().Lookup("wallet-key-switching"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("wallet-fingerprints", rootCmd.PersistentFlags().Lookup("wallet-fingerprints"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("wallet-key-sync-timeout", rootCmd.PersistentFlags().Lookup("wallet-key-sync-timeout"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("watch-address-interval", rootCmd.PersistentFlags().Lookup("watch-address-interval"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("request-min-intervals", rootCmd.PersistentFlags().Lookup("request-min-intervals"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("wallet-coin-interval", rootCmd.PersistentFlags().Lookup("wallet-coin-interval"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("wallet-dust-threshold", rootCmd.PersistentFlags().Lookup("wallet-dust-threshold"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("wallet-cat-dust-thresholds", rootCmd.PersistentFlags().Lookup("wallet-cat-dust-thresholds"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("wallet-max-send-quantity", rootCmd.PersistentFlags().Lookup("wallet-max-send-quantity"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("full-node-peer-metrics", rootCmd.PersistentFlags().Lookup("full-node-peer-metrics"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = viper.BindPFlag("full-node-peer-metrics-limit", rootCmd.PersistentFlags().Lookup("full-node-peer-metrics-limit"))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -25,6 +25,8 @@ var serveCmd = &cobra.Command{
 			log.Fatalln(err.Error())
 		}
 
+		m.StartBackgroundTasks()
+
 		// Run this in the background, so the metrics healthz endpoint can come up while waiting for STAI
 		go startWebsocket(m)
 
@@ -2,8 +2,9 @@ package metrics
 
 import (
 	"encoding/json"
-	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -13,8 +14,6 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/viper"
 
-	"github.com/oschwald/maxminddb-golang"
-
 	wrappedPrometheus "github.com/forks-lab/stai-exporter/internal/prometheus"
 	"github.com/forks-lab/stai-exporter/internal/utils"
 )
@@ -27,7 +26,15 @@ type CrawlerServiceMetrics struct {
 	metrics *Metrics
 
 	// Interfaces with Maxmind
-	maxMindDB *maxminddb.Reader
+	maxMindDB *maxmindDB
+	asnDB     *maxmindDB
+	cityDB    *maxmindDB
+
+	// mappingInProgress is set while IPs are being mapped to countries, so only one mapping runs at a time
+	mappingInProgress int32
+
+	// countries holds the country labels set by the last mapping, and is only used by the mapping goroutine
+	countries map[string]string
 
 	// Crawler Metrics
 	totalNodes5Days         *wrappedPrometheus.LazyGauge
@@ -36,6 +43,23 @@ type CrawlerServiceMetrics struct {
 	ipv6Nodes5Days          *wrappedPrometheus.LazyGauge
 	versionBuckets          *prometheus.GaugeVec
 	countryNodeCountBuckets *prometheus.GaugeVec
+	maxmindBuildEpoch       *prometheus.GaugeVec
+
+	// ASN Metrics
+	// asns holds the asn labels set by the last mapping, and is only used by the mapping goroutine
+	asns                map[string]string
+	hostingASNs         map[uint]bool
+	asnNodeCountBuckets *prometheus.GaugeVec
+	networkTypeBuckets  *prometheus.GaugeVec
+
+	// City Metrics
+	// regions holds the region labels set by the last mapping, and is only used by the mapping goroutine
+	regions                map[string]*regionCount
+	regionNodeCountBuckets *prometheus.GaugeVec
+
+	// peerMap holds the number of peers in each grid cell, served as GeoJSON
+	peerMapLock sync.Mutex
+	peerMap     []*geoJSONFeature
 }
 
 // InitMetrics sets all the metrics properties
@@ -47,28 +71,33 @@ func (s *CrawlerServiceMetrics) InitMetrics() {
 	s.ipv6Nodes5Days = s.metrics.newGauge(staiServiceCrawler, "ipv6_nodes_5_days", "Total number of IPv6 nodes that have been gossiped around the network with a timestamp in the last 5 days. The crawler did not necessarily connect to all of these peers itself.")
 	s.versionBuckets = s.metrics.newGaugeVec(staiServiceCrawler, "peer_version", "Number of peers for each version. Only peers the crawler was able to connect to are included here.", []string{"version"})
 	s.countryNodeCountBuckets = s.metrics.newGaugeVec(staiServiceCrawler, "country_node_count", "Number of peers gossiped in the last 5 days from each country.", []string{"country", "country_display"})
+	s.maxmindBuildEpoch = s.metrics.newGaugeVec(staiServiceCrawler, "maxmind_build_epoch", "Time the loaded maxmind database was built, as a unix timestamp", []string{"database"})
 
-	err := s.initMaxmindDB()
-	if err != nil {
-		// Continue on maxmind error - optional/not critical functionality
-		log.Errorf("Error initializing maxmind DB: %s\n", err.Error())
-	}
+	s.initASNMetrics()
+	s.initCityMetrics()
+
+	s.initMaxmindDB()
 }
 
-// initMaxmindDB loads the maxmind DB if the file is present
-// If the DB is not present, ip/country mapping is skipped
-func (s *CrawlerServiceMetrics) initMaxmindDB() error {
-	var err error
-	dbPath := viper.GetString("maxmind-db-path")
-	if dbPath == "" {
-		return nil
-	}
-	s.maxMindDB, err = maxminddb.Open(dbPath)
-	if err != nil {
-		return err
-	}
+// initMaxmindDB loads the maxmind DBs if the files are present
+// If a DB is not present, that part of the ip mapping is skipped. DBs that fail to load are tried again when the
+// files are checked for changes
+func (s *CrawlerServiceMetrics) initMaxmindDB() {
+	s.maxMindDB = newMaxmindDB("country", viper.GetString("maxmind-db-path"))
+	s.asnDB = newMaxmindDB("asn", viper.GetString("maxmind-asn-db-path"))
+	s.cityDB = newMaxmindDB("city", viper.GetString("maxmind-city-db-path"))
 
-	return nil
+	// Continue on maxmind error - optional/not critical functionality
+	s.ReloadMaxmindDBs()
+}
+
+// StartBackgroundTasks checks the maxmind DB files for changes on the configured interval, so updated DBs are used
+// without restarting
+func (s *CrawlerServiceMetrics) StartBackgroundTasks() {
+	if len(s.databases()) == 0 {
+		return
+	}
+	startPolling(viper.GetDuration("maxmind-db-refresh-interval"), s.ReloadMaxmindDBs)
 }
 
 // InitialData is called on startup of the metrics server, to allow seeding metrics with current/initial data
@@ -84,6 +113,10 @@ func (s *CrawlerServiceMetrics) Disconnected() {
 	s.ipv6Nodes5Days.Unregister()
 	s.versionBuckets.Reset()
 	s.countryNodeCountBuckets.Reset()
+	s.asnNodeCountBuckets.Reset()
+	s.networkTypeBuckets.Reset()
+	s.regionNodeCountBuckets.Reset()
+	s.setPeerMap(nil)
 }
 
 // Reconnected is called when the service is reconnected after the websocket was disconnected
@@ -126,11 +159,28 @@ func (s *CrawlerServiceMetrics) GetPeerCounts(resp *types.WebsocketResponse) {
 	}
 }
 
+// countryCount is the number of IPs seen in a country
+type countryCount struct {
+	ISOCode string
+	Name    string
+	Count   float64
+}
+
+// ipCounts holds the number of IPs in each group, as pages of IPs are received from the crawler
+type ipCounts struct {
+	countries   map[string]*countryCount
+	asns        map[uint]*asnCount
+	hosting     float64
+	residential float64
+	regions     map[string]*regionCount
+	cells       map[geoCell]float64
+}
+
 // StartIPCountryMapping starts the process to fetch current IPs from the crawler
-// and maps them to countries using maxmind
-// Updates metrics value once all pages have been received
+// and maps them to countries, regions, and autonomous systems using maxmind
+// Only one mapping runs at a time, so batches completed while a mapping is running are skipped
 func (s *CrawlerServiceMetrics) StartIPCountryMapping(limit uint) {
-	if s.maxMindDB == nil {
+	if !s.maxMindDB.loaded() && !s.asnDB.loaded() && !s.cityDB.loaded() {
 		return
 	}
 
@@ -139,39 +189,81 @@ func (s *CrawlerServiceMetrics) StartIPCountryMapping(limit uint) {
 		return
 	}
 
-	log.Println("Requesting IP addresses from the past 5 days for country mapping...")
-
-	ipsAfterTimestamp, _, err := s.metrics.httpClient.CrawlerService.GetIPsAfterTimestamp(&rpc.GetIPsAfterTimestampOptions{
-		After: time.Now().Add(-5 * time.Hour * 24).Unix(),
-		Limit: limit,
-	})
-	if err != nil {
-		log.Errorf("Error getting IPs: %s\n", err.Error())
+	if !atomic.CompareAndSwapInt32(&s.mappingInProgress, 0, 1) {
+		log.Debugln("IP country mapping is already in progress, skipping")
 		return
 	}
 
-	s.GetIPsAfterTimestamp(ipsAfterTimestamp)
+	go func() {
+		defer atomic.StoreInt32(&s.mappingInProgress, 0)
+		s.mapIPCountries(limit)
+	}()
 }
 
-// GetIPsAfterTimestamp processes a response of IPs seen since a timestamp
-// Currently assumes all IPs will be in one response
-func (s *CrawlerServiceMetrics) GetIPsAfterTimestamp(ips *rpc.GetIPsAfterTimestampResponse) {
-	if s.maxMindDB == nil {
-		return
+// mapIPCountries requests IPs from the crawler a page at a time, counting the IPs in each country as pages are
+// received. Updates metrics value once all pages have been received
+func (s *CrawlerServiceMetrics) mapIPCountries(limit uint) {
+	log.Println("Requesting IP addresses from the past 5 days for country mapping...")
+
+	pageSize := uint(viper.GetInt("crawler-ip-page-size"))
+	if pageSize == 0 {
+		pageSize = limit
 	}
+	after := time.Now().Add(-5 * time.Hour * 24).Unix()
 
-	if ips == nil {
-		return
+	counts := &ipCounts{
+		countries: map[string]*countryCount{},
+		asns:      map[uint]*asnCount{},
+		regions:   map[string]*regionCount{},
+		cells:     map[geoCell]float64{},
+	}
+	for offset := uint(0); offset < limit; offset += pageSize {
+		ipsAfterTimestamp, _, err := s.metrics.httpClient.CrawlerService.GetIPsAfterTimestamp(&rpc.GetIPsAfterTimestampOptions{
+			After:  after,
+			Offset: offset,
+			Limit:  pageSize,
+		})
+		if err != nil {
+			log.Errorf("Error getting IPs: %s\n", err.Error())
+			return
+		}
+
+		s.GetIPsAfterTimestamp(ipsAfterTimestamp, counts)
+		if ipsAfterTimestamp == nil || uint(len(ipsAfterTimestamp.IPs)) < pageSize {
+			break
+		}
+	}
+
+	if s.maxMindDB.loaded() {
+		s.setCountryCounts(counts.countries)
+	}
+	if s.asnDB.loaded() {
+		s.setASNCounts(counts)
+	}
+	if s.cityDB.loaded() {
+		s.setRegionCounts(counts.regions)
+		s.setPeerMap(counts.cells)
 	}
+}
 
-	type countStruct struct {
-		ISOCode string
-		Name    string
-		Count   float64
+// GetIPsAfterTimestamp processes a page of IPs seen since a timestamp, adding them to the counts for each country
+// region, and autonomous system
+func (s *CrawlerServiceMetrics) GetIPsAfterTimestamp(ips *rpc.GetIPsAfterTimestampResponse, counts *ipCounts) {
+	if ips == nil {
+		return
 	}
-	countryCounts := map[string]*countStruct{}
 
 	for _, ip := range ips.IPs {
+		if s.asnDB.loaded() {
+			s.countASN(ip, counts)
+		}
+		if s.cityDB.loaded() {
+			s.countCity(ip, counts)
+		}
+		if !s.maxMindDB.loaded() {
+			continue
+		}
+
 		country, err := s.GetCountryForIP(ip)
 		if err != nil || country.Country.ISOCode == "" {
 			continue
@@ -180,19 +272,30 @@ func (s *CrawlerServiceMetrics) GetIPsAfterTimestamp(ips *rpc.GetIPsAfterTimesta
 		countryName := ""
 		countryName = country.Country.Names["en"]
 
-		if _, ok := countryCounts[country.Country.ISOCode]; !ok {
-			countryCounts[country.Country.ISOCode] = &countStruct{
+		if _, ok := counts.countries[country.Country.ISOCode]; !ok {
+			counts.countries[country.Country.ISOCode] = &countryCount{
 				ISOCode: country.Country.ISOCode,
 				Name:    countryName,
 				Count:   0,
 			}
 		}
 
-		countryCounts[country.Country.ISOCode].Count++
+		counts.countries[country.Country.ISOCode].Count++
 	}
+}
 
+// setCountryCounts updates the country metrics, and removes countries that no longer have any peers
+func (s *CrawlerServiceMetrics) setCountryCounts(countryCounts map[string]*countryCount) {
+	for isoCode, name := range s.countries {
+		if _, ok := countryCounts[isoCode]; !ok {
+			s.countryNodeCountBuckets.DeleteLabelValues(isoCode, name)
+		}
+	}
+
+	s.countries = map[string]string{}
 	for _, countryData := range countryCounts {
 		s.countryNodeCountBuckets.WithLabelValues(countryData.ISOCode, countryData.Name).Set(countryData.Count)
+		s.countries[countryData.ISOCode] = countryData.Name
 	}
 }
 
@@ -209,10 +312,6 @@ type Country struct {
 
 // GetCountryForIP Gets country data for an ip address
 func (s *CrawlerServiceMetrics) GetCountryForIP(ipStr string) (*CountryRecord, error) {
-	if s.maxMindDB == nil {
-		return nil, fmt.Errorf("maxmind not initialized")
-	}
-
 	ip := net.ParseIP(ipStr)
 
 	record := &CountryRecord{}
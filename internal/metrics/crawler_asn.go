@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/spf13/viper"
+)
+
+// Metrics for the autonomous systems of crawled peers are in this file
+
+const (
+	// asnOther is the asn and organization label for the autonomous systems beyond crawler-asn-limit
+	asnOther = "other"
+
+	// networkTypeHosting and networkTypeResidential are the network_type labels for peers in and not in hosting-asns
+	networkTypeHosting     = "hosting"
+	networkTypeResidential = "residential"
+)
+
+// defaultHostingASNs are the autonomous systems of large hosting and cloud providers, used when hosting-asns is empty
+var defaultHostingASNs = []int{
+	16509,  // Amazon
+	14618,  // Amazon
+	15169,  // Google
+	396982, // Google Cloud
+	8075,   // Microsoft
+	31898,  // Oracle
+	45102,  // Alibaba
+	132203, // Tencent
+	14061,  // DigitalOcean
+	24940,  // Hetzner
+	16276,  // OVH
+	63949,  // Linode
+	20473,  // Vultr
+	51167,  // Contabo
+	12876,  // Scaleway
+}
+
+// ASNRecord record of an autonomous system from maxmind
+type ASNRecord struct {
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+// asnCount is the number of IPs seen in an autonomous system
+type asnCount struct {
+	ASN          string
+	Organization string
+	Count        float64
+}
+
+// initASNMetrics sets up the autonomous system metrics
+func (s *CrawlerServiceMetrics) initASNMetrics() {
+	hostingASNs := viper.GetIntSlice("hosting-asns")
+	if len(hostingASNs) == 0 {
+		hostingASNs = defaultHostingASNs
+	}
+	s.hostingASNs = map[uint]bool{}
+	for _, asn := range hostingASNs {
+		s.hostingASNs[uint(asn)] = true
+	}
+
+	s.asnNodeCountBuckets = s.metrics.newGaugeVec(staiServiceCrawler, "asn_node_count", "Number of peers gossiped in the last 5 days from each autonomous system. Autonomous systems beyond crawler-asn-limit are combined into \"other\".", []string{"asn", "organization"})
+	s.networkTypeBuckets = s.metrics.newGaugeVec(staiServiceCrawler, "network_type_node_count", "Number of peers gossiped in the last 5 days from hosting providers, based on hosting-asns, and from all other networks.", []string{"network_type"})
+}
+
+// GetASNForIP Gets autonomous system data for an ip address
+func (s *CrawlerServiceMetrics) GetASNForIP(ipStr string) (*ASNRecord, error) {
+	ip := net.ParseIP(ipStr)
+
+	record := &ASNRecord{}
+
+	err := s.asnDB.Lookup(ip, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// countASN adds an IP to the counts for its autonomous system and network type
+func (s *CrawlerServiceMetrics) countASN(ip string, counts *ipCounts) {
+	record, err := s.GetASNForIP(ip)
+	if err != nil || record.AutonomousSystemNumber == 0 {
+		return
+	}
+
+	if _, ok := counts.asns[record.AutonomousSystemNumber]; !ok {
+		counts.asns[record.AutonomousSystemNumber] = &asnCount{
+			ASN:          fmt.Sprintf("%d", record.AutonomousSystemNumber),
+			Organization: record.AutonomousSystemOrganization,
+		}
+	}
+	counts.asns[record.AutonomousSystemNumber].Count++
+
+	if s.hostingASNs[record.AutonomousSystemNumber] {
+		counts.hosting++
+	} else {
+		counts.residential++
+	}
+}
+
+// setASNCounts updates the autonomous system metrics with the top crawler-asn-limit autonomous systems, and removes
+// ones that are no longer included, or whose organization changed in an updated database
+func (s *CrawlerServiceMetrics) setASNCounts(counts *ipCounts) {
+	top := capASNCounts(counts.asns, viper.GetInt("crawler-asn-limit"))
+
+	included := map[string]string{}
+	for _, asnData := range top {
+		included[asnData.ASN] = asnData.Organization
+	}
+	for asn, organization := range s.asns {
+		if includedOrganization, ok := included[asn]; !ok || includedOrganization != organization {
+			s.asnNodeCountBuckets.DeleteLabelValues(asn, organization)
+		}
+	}
+
+	s.asns = map[string]string{}
+	for _, asnData := range top {
+		s.asnNodeCountBuckets.WithLabelValues(asnData.ASN, asnData.Organization).Set(asnData.Count)
+		s.asns[asnData.ASN] = asnData.Organization
+	}
+
+	s.networkTypeBuckets.WithLabelValues(networkTypeHosting).Set(counts.hosting)
+	s.networkTypeBuckets.WithLabelValues(networkTypeResidential).Set(counts.residential)
+}
+
+// capASNCounts returns the autonomous systems with the most peers, with any beyond the limit combined into "other"
+func capASNCounts(asns map[uint]*asnCount, limit int) []*asnCount {
+	var sorted []*asnCount
+	for _, asnData := range asns {
+		sorted = append(sorted, asnData)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].ASN < sorted[j].ASN
+	})
+
+	if limit <= 0 || len(sorted) <= limit {
+		return sorted
+	}
+
+	// Leave room for the "other" group within the limit
+	keep := limit - 1
+	other := &asnCount{ASN: asnOther, Organization: asnOther}
+	for _, asnData := range sorted[keep:] {
+		other.Count += asnData.Count
+	}
+
+	return append(sorted[:keep], other)
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestCapASNCounts(t *testing.T) {
+	asns := func() map[uint]*asnCount {
+		return map[uint]*asnCount{
+			100: {ASN: "100", Organization: "A", Count: 5},
+			300: {ASN: "300", Organization: "C", Count: 3},
+			200: {ASN: "200", Organization: "B", Count: 3},
+			400: {ASN: "400", Organization: "D", Count: 1},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		limit      int
+		wantASNs   []string
+		wantCounts []float64
+	}{
+		{
+			name:       "no limit",
+			limit:      0,
+			wantASNs:   []string{"100", "200", "300", "400"},
+			wantCounts: []float64{5, 3, 3, 1},
+		},
+		{
+			name:       "under the limit",
+			limit:      4,
+			wantASNs:   []string{"100", "200", "300", "400"},
+			wantCounts: []float64{5, 3, 3, 1},
+		},
+		{
+			name:       "ties are cut by asn",
+			limit:      3,
+			wantASNs:   []string{"100", "200", asnOther},
+			wantCounts: []float64{5, 3, 4},
+		},
+		{
+			name:       "limit of one",
+			limit:      1,
+			wantASNs:   []string{asnOther},
+			wantCounts: []float64{12},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capped := capASNCounts(asns(), tt.limit)
+			if len(capped) != len(tt.wantASNs) {
+				t.Fatalf("got %d autonomous systems, want %d", len(capped), len(tt.wantASNs))
+			}
+			for i, asnData := range capped {
+				if asnData.ASN != tt.wantASNs[i] || asnData.Count != tt.wantCounts[i] {
+					t.Errorf("autonomous system %d = %s with %v peers, want %s with %v peers", i, asnData.ASN, asnData.Count, tt.wantASNs[i], tt.wantCounts[i])
+				}
+			}
+			if last := capped[len(capped)-1]; last.ASN == asnOther && last.Organization != asnOther {
+				t.Errorf("other organization = %s, want %s", last.Organization, asnOther)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Region metrics and the map of crawled peers, from the city database, are in this file
+
+// CityRecord record of a city from maxmind. Only the fields used for regions and locations are included
+type CityRecord struct {
+	Country      Country       `maxminddb:"country"`
+	Subdivisions []Subdivision `maxminddb:"subdivisions"`
+	Location     Location      `maxminddb:"location"`
+}
+
+// Subdivision record of a region, such as a state or province, from maxmind
+type Subdivision struct {
+	ISOCode string            `maxminddb:"iso_code"`
+	Names   map[string]string `maxminddb:"names"`
+}
+
+// Location record of the approximate location of an ip address from maxmind
+type Location struct {
+	Latitude  float64 `maxminddb:"latitude"`
+	Longitude float64 `maxminddb:"longitude"`
+}
+
+// regionCount is the number of IPs seen in a region of a country
+type regionCount struct {
+	Country string
+	Region  string
+	Name    string
+	Count   float64
+}
+
+// geoCell is the center of a grid cell that peers are grouped into for the map, so no individual locations are served
+type geoCell struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// geoJSONFeatureCollection is the GeoJSON document served for the map of peers
+type geoJSONFeatureCollection struct {
+	Type     string            `json:"type"`
+	Features []*geoJSONFeature `json:"features"`
+}
+
+// geoJSONFeature is a point with the number of peers in a grid cell
+type geoJSONFeature struct {
+	Type     string `json:"type"`
+	Geometry struct {
+		Type        string     `json:"type"`
+		Coordinates [2]float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties struct {
+		Peers float64 `json:"peers"`
+	} `json:"properties"`
+}
+
+// initCityMetrics sets up the region metrics
+func (s *CrawlerServiceMetrics) initCityMetrics() {
+	s.regionNodeCountBuckets = s.metrics.newGaugeVec(staiServiceCrawler, "region_node_count", "Number of peers gossiped in the last 5 days from each region, such as a state or province, of each country.", []string{"country", "region", "region_display"})
+}
+
+// RegisterEndpoints adds the map of peers endpoint to the metrics server
+func (s *CrawlerServiceMetrics) RegisterEndpoints(mux *http.ServeMux) {
+	mux.HandleFunc("/crawler/peers.geojson", s.peerMapEndpoint)
+}
+
+// GetCityForIP Gets city data for an ip address
+func (s *CrawlerServiceMetrics) GetCityForIP(ipStr string) (*CityRecord, error) {
+	ip := net.ParseIP(ipStr)
+
+	record := &CityRecord{}
+
+	err := s.cityDB.Lookup(ip, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// countCity adds an IP to the counts for its region and map cell
+func (s *CrawlerServiceMetrics) countCity(ip string, counts *ipCounts) {
+	record, err := s.GetCityForIP(ip)
+	if err != nil || record.Country.ISOCode == "" {
+		return
+	}
+
+	if len(record.Subdivisions) > 0 && record.Subdivisions[0].ISOCode != "" {
+		subdivision := record.Subdivisions[0]
+		key := record.Country.ISOCode + "-" + subdivision.ISOCode
+		if _, ok := counts.regions[key]; !ok {
+			counts.regions[key] = &regionCount{
+				Country: record.Country.ISOCode,
+				Region:  subdivision.ISOCode,
+				Name:    subdivision.Names["en"],
+			}
+		}
+		counts.regions[key].Count++
+	}
+
+	// Locations of 0,0 mean maxmind only knows the country
+	if record.Location.Latitude != 0 || record.Location.Longitude != 0 {
+		counts.cells[cellFor(record.Location, viper.GetFloat64("geojson-cell-size"))]++
+	}
+}
+
+// cellFor returns the center of the grid cell a location is in
+func cellFor(location Location, size float64) geoCell {
+	if size <= 0 {
+		size = 1
+	}
+	center := func(coordinate float64) float64 {
+		c := math.Floor(coordinate/size)*size + size/2
+		// Avoid floating point noise in the served coordinates
+		return math.Round(c*1e6) / 1e6
+	}
+	return geoCell{Latitude: center(location.Latitude), Longitude: center(location.Longitude)}
+}
+
+// setRegionCounts updates the region metrics, and removes regions that no longer have any peers, or whose name
+// changed in an updated database
+func (s *CrawlerServiceMetrics) setRegionCounts(regionCounts map[string]*regionCount) {
+	for key, region := range s.regions {
+		if regionData, ok := regionCounts[key]; !ok || regionData.Name != region.Name {
+			s.regionNodeCountBuckets.DeleteLabelValues(region.Country, region.Region, region.Name)
+		}
+	}
+
+	s.regions = map[string]*regionCount{}
+	for key, regionData := range regionCounts {
+		s.regionNodeCountBuckets.WithLabelValues(regionData.Country, regionData.Region, regionData.Name).Set(regionData.Count)
+		s.regions[key] = regionData
+	}
+}
+
+// setPeerMap replaces the map of peers served as GeoJSON
+func (s *CrawlerServiceMetrics) setPeerMap(cells map[geoCell]float64) {
+	features := make([]*geoJSONFeature, 0, len(cells))
+	for cell, count := range cells {
+		feature := &geoJSONFeature{Type: "Feature"}
+		feature.Geometry.Type = "Point"
+		// GeoJSON coordinates are longitude first
+		feature.Geometry.Coordinates = [2]float64{cell.Longitude, cell.Latitude}
+		feature.Properties.Peers = count
+		features = append(features, feature)
+	}
+	sort.Slice(features, func(i, j int) bool {
+		return features[i].Properties.Peers > features[j].Properties.Peers
+	})
+
+	s.peerMapLock.Lock()
+	s.peerMap = features
+	s.peerMapLock.Unlock()
+}
+
+// peerMapEndpoint returns the number of peers in each grid cell as a GeoJSON feature collection
+func (s *CrawlerServiceMetrics) peerMapEndpoint(w http.ResponseWriter, r *http.Request) {
+	s.peerMapLock.Lock()
+	collection := &geoJSONFeatureCollection{Type: "FeatureCollection", Features: s.peerMap}
+	if collection.Features == nil {
+		collection.Features = []*geoJSONFeature{}
+	}
+	s.peerMapLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	err := json.NewEncoder(w).Encode(collection)
+	if err != nil {
+		log.Errorf("Error writing peer map response %s\n", err.Error())
+	}
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// Loading and reloading of the MaxMind databases used to map crawled IPs is in this file
+
+// maxmindDB is a MaxMind database that is reopened when the file changes, so databases can be updated without
+// restarting the exporter
+type maxmindDB struct {
+	// name is used as the database label, and in logs
+	name string
+	path string
+
+	// lock is held for reading during lookups, so the reader isn't closed while it is in use
+	lock    sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+// newMaxmindDB returns a database for path, or nil if no path is configured
+func newMaxmindDB(name string, path string) *maxmindDB {
+	if path == "" {
+		return nil
+	}
+	return &maxmindDB{name: name, path: path}
+}
+
+// loaded returns true if the database is configured and has been opened
+func (d *maxmindDB) loaded() bool {
+	if d == nil {
+		return false
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.reader != nil
+}
+
+// Lookup looks up an IP in the database, decoding the record into result
+func (d *maxmindDB) Lookup(ip net.IP, result interface{}) error {
+	if d == nil {
+		return fmt.Errorf("maxmind not initialized")
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.reader == nil {
+		return fmt.Errorf("maxmind %s db not loaded", d.name)
+	}
+	return d.reader.Lookup(ip, result)
+}
+
+// Reload reads the database file if it changed since it was last read, and swaps it in for the previous one
+// The file is read into memory rather than memory mapped, so it can be overwritten in place without breaking lookups.
+// Returns true if a new database was loaded. If the new file can't be read, the previous database is kept and
+// reading is tried again on the next reload, in case the file was still being written
+func (d *maxmindDB) Reload() (bool, error) {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return false, err
+	}
+
+	d.lock.RLock()
+	unchanged := d.reader != nil && info.ModTime().Equal(d.modTime) && info.Size() == d.size
+	d.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	contents, err := os.ReadFile(d.path)
+	if err != nil {
+		return false, err
+	}
+	reader, err := maxminddb.FromBytes(contents)
+	if err != nil {
+		return false, err
+	}
+
+	// Waits for any lookups using the previous reader to finish
+	d.lock.Lock()
+	previous := d.reader
+	d.reader = reader
+	d.modTime = info.ModTime()
+	d.size = info.Size()
+	d.lock.Unlock()
+
+	if previous != nil {
+		log.Infof("Reloaded maxmind %s db from %s\n", d.name, d.path)
+		err = previous.Close()
+		if err != nil {
+			log.Errorf("Error closing previous maxmind %s db: %s\n", d.name, err.Error())
+		}
+	}
+	return true, nil
+}
+
+// BuildEpoch returns the time the loaded database was built, as a unix timestamp
+func (d *maxmindDB) BuildEpoch() uint {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.reader == nil {
+		return 0
+	}
+	return d.reader.Metadata.BuildEpoch
+}
+
+// databases returns the configured maxmind databases
+func (s *CrawlerServiceMetrics) databases() []*maxmindDB {
+	var databases []*maxmindDB
+	for _, db := range []*maxmindDB{s.maxMindDB, s.asnDB, s.cityDB} {
+		if db != nil {
+			databases = append(databases, db)
+		}
+	}
+	return databases
+}
+
+// ReloadMaxmindDBs reopens any maxmind databases that changed since they were last opened
+func (s *CrawlerServiceMetrics) ReloadMaxmindDBs() {
+	for _, db := range s.databases() {
+		reloaded, err := db.Reload()
+		if err != nil {
+			log.Errorf("Error loading maxmind %s db: %s\n", db.name, err.Error())
+			continue
+		}
+		if reloaded {
+			s.maxmindBuildEpoch.WithLabelValues(db.name).Set(float64(db.BuildEpoch()))
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"math"
+	"sync"
+
+	"github.com/spf13/viper"
+
+	wrappedPrometheus "github.com/forks-lab/stai-exporter/internal/prometheus"
+)
+
+// Metrics derived from data from more than one service are in this file
+
+const (
+	// blocksPerDay is the target number of blocks per day (32 blocks every 10 minutes)
+	blocksPerDay = 4608
+
+	// uiActualSpaceConstantFactor matches UI_ACTUAL_SPACE_CONSTANT_FACTOR in STAI, which converts the expected size of a
+	// plot to the space it effectively contributes to the network space estimate
+	uiActualSpaceConstantFactor = 0.762
+)
+
+// effectivePlotSize returns the space a plot of size k effectively contributes, regardless of the size of the file
+// on disk. This keeps estimates accurate for compressed or otherwise unusual plots
+func effectivePlotSize(k uint8) float64 {
+	return float64(2*uint64(k)+1) * math.Pow(2, float64(k)-1) * uiActualSpaceConstantFactor
+}
+
+// EstimateMetrics contains metrics that combine the farm's plots with the network space to estimate farming rewards
+type EstimateMetrics struct {
+	// Holds a reference to the main metrics container this is a part of
+	metrics *Metrics
+
+	// Inputs from the full node and harvester. Updated from different goroutines, so protected by lock
+	lock               sync.Mutex
+	netspaceBytes      float64
+	effectivePlotSpace float64
+
+	// Estimate Metrics
+	effectiveSpace       *wrappedPrometheus.LazyGauge
+	spaceShare           *wrappedPrometheus.LazyGauge
+	estimatedTimeToWin   *wrappedPrometheus.LazyGauge
+	expectedBlocksPerDay *wrappedPrometheus.LazyGauge
+	expectedRewardPerDay *wrappedPrometheus.LazyGauge
+}
+
+// InitMetrics sets all the metrics properties
+func (s *EstimateMetrics) InitMetrics() {
+	s.effectiveSpace = s.metrics.newGauge(staiServiceEstimates, "effective_plot_space", "Effective space of all plots on this harvester, in bytes, based on k size rather than file size")
+	s.spaceShare = s.metrics.newGauge(staiServiceEstimates, "space_share", "Share of the estimated network space held by the plots on this harvester, from 0 to 1")
+	s.estimatedTimeToWin = s.metrics.newGauge(staiServiceEstimates, "time_to_win_seconds", "Expected time until the plots on this harvester win a block, in seconds")
+	s.expectedBlocksPerDay = s.metrics.newGauge(staiServiceEstimates, "expected_blocks_per_day", "Expected number of blocks won per day by the plots on this harvester")
+	s.expectedRewardPerDay = s.metrics.newGauge(staiServiceEstimates, "expected_reward_per_day", "Expected block rewards per day for the plots on this harvester, in mojos. Excludes fees")
+}
+
+// SetNetspace updates the network space estimate, in bytes, and recomputes estimates
+func (s *EstimateMetrics) SetNetspace(bytes float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.netspaceBytes = bytes
+	s.recompute()
+}
+
+// SetEffectivePlotSpace updates the effective space of the plots on the harvester, in bytes, and recomputes estimates
+func (s *EstimateMetrics) SetEffectivePlotSpace(bytes float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.effectivePlotSpace = bytes
+	s.recompute()
+}
+
+// Unregister stops reporting the estimates until new data is received
+func (s *EstimateMetrics) Unregister() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.netspaceBytes = 0
+	s.effectivePlotSpace = 0
+	s.effectiveSpace.Unregister()
+	s.spaceShare.Unregister()
+	s.estimatedTimeToWin.Unregister()
+	s.expectedBlocksPerDay.Unregister()
+	s.expectedRewardPerDay.Unregister()
+}
+
+// recompute updates all estimates from the current inputs. Must be called with the lock held
+func (s *EstimateMetrics) recompute() {
+	if s.effectivePlotSpace > 0 {
+		s.effectiveSpace.Set(s.effectivePlotSpace)
+	}
+
+	// Can't estimate anything until we know about both the network and the farm
+	if s.netspaceBytes <= 0 || s.effectivePlotSpace <= 0 {
+		return
+	}
+
+	share := s.effectivePlotSpace / s.netspaceBytes
+	blocks := share * blocksPerDay
+
+	s.spaceShare.Set(share)
+	s.expectedBlocksPerDay.Set(blocks)
+	s.estimatedTimeToWin.Set(86400 / blocks)
+	s.expectedRewardPerDay.Set(blocks * float64(viper.GetUint64("block-reward")))
+}
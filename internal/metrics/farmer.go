@@ -2,10 +2,15 @@ package metrics
 
 import (
 	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
 
+	"github.com/forks-lab/go-stai-libs/pkg/rpcinterface"
 	"github.com/forks-lab/go-stai-libs/pkg/types"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 
 	wrappedPrometheus "github.com/forks-lab/stai-exporter/internal/prometheus"
 )
@@ -22,8 +27,45 @@ type FarmerServiceMetrics struct {
 	currentDifficulty   *prometheus.GaugeVec
 	pointsAckSinceStart *prometheus.GaugeVec
 
+	// Pool State Metrics
+	poolInfo             *prometheus.GaugeVec
+	pointsFound24h       *prometheus.GaugeVec
+	pointsAck24h         *prometheus.GaugeVec
+	poolErrors24h        *prometheus.GaugeVec
+	lastPartialTimestamp *prometheus.GaugeVec
+
+	// Labels set from the last pool state, so only pools and error codes that disappeared are removed
+	// Only used by the pool state polling
+	poolURLs     map[string]string
+	poolErrors   map[poolErrorLabels]bool
+	lastPartials map[string]bool
+
 	// Proof Metrics
 	proofsFound *wrappedPrometheus.LazyCounter
+
+	// Harvester Metrics, for each harvester connected to this farmer
+	harvesterPlots              *prometheus.GaugeVec
+	harvesterPlotSize           *prometheus.GaugeVec
+	harvesterFailedToOpen       *prometheus.GaugeVec
+	harvesterNoKey              *prometheus.GaugeVec
+	harvesterDuplicates         *prometheus.GaugeVec
+	harvesterSyncing            *prometheus.GaugeVec
+	harvesterSyncFilesProcessed *prometheus.GaugeVec
+	harvesterSyncFilesTotal     *prometheus.GaugeVec
+	harvesterLastSyncTime       *prometheus.GaugeVec
+	harvesterPassedFilter       *prometheus.GaugeVec
+	harvesterPassedFilterTotal  *prometheus.CounterVec
+	harvesterProofsTotal        *prometheus.CounterVec
+	harvesterLookupTime         *prometheus.GaugeVec
+	harvesterLastSeen           *prometheus.GaugeVec
+
+	// harvesterHosts maps harvester node IDs to hosts, from the harvester summary
+	// farming info events only include the node ID
+	harvesterHosts     map[string]string
+	harvesterHostsLock sync.Mutex
+
+	// summaryInProgress is set while a harvester summary requested for an unknown harvester is being fetched
+	summaryInProgress int32
 }
 
 // InitMetrics sets all the metrics properties
@@ -34,15 +76,50 @@ func (s *FarmerServiceMetrics) InitMetrics() {
 	s.currentDifficulty = s.metrics.newGaugeVec(staiServiceFarmer, "current_difficulty", "Current difficulty for this launcher id", poolLabels)
 	s.pointsAckSinceStart = s.metrics.newGaugeVec(staiServiceFarmer, "points_acknowledged_since_start", "Points acknowledged since start. This is calculated by STAI, NOT since start of the exporter.", poolLabels)
 
+	// Pool State Metrics, by launcher ID
+	s.poolInfo = s.metrics.newGaugeVec(staiServiceFarmer, "pool_info", "Information about the pool for this launcher id. Value is always 1", []string{"launcher_id", "pool_url"})
+	s.pointsFound24h = s.metrics.newGaugeVec(staiServiceFarmer, "points_found_24h", "Points found in the last 24 hours for this launcher id", poolLabels)
+	s.pointsAck24h = s.metrics.newGaugeVec(staiServiceFarmer, "points_acknowledged_24h", "Points acknowledged by the pool in the last 24 hours for this launcher id", poolLabels)
+	s.poolErrors24h = s.metrics.newGaugeVec(staiServiceFarmer, "pool_errors_24h", "Number of errors returned by the pool in the last 24 hours, by error code", []string{"launcher_id", "error_code"})
+	s.lastPartialTimestamp = s.metrics.newGaugeVec(staiServiceFarmer, "last_partial_timestamp", "Unix timestamp of the last partial that was acknowledged by the pool in the last 24 hours", poolLabels)
+
 	// Proof Metrics
 	s.proofsFound = s.metrics.newCounter(staiServiceFarmer, "proofs_found", "Number of proofs found since the exporter has been running")
+
+	// Harvester Metrics, by harvester
+	harvesterLabels := []string{"node_id", "host"}
+	s.harvesterPlots = s.metrics.newGaugeVec(staiServiceFarmer, "harvester_plots", "Number of plots on each harvester connected to the farmer", harvesterLabels)
+	s.harvesterPlotSize = s.metrics.newGaugeVec(staiServiceFarmer, "harvester_plot_size", "Total size of plots on each harvester connected to the farmer, in bytes", harvesterLabels)
+	s.harvesterFailedToOpen = s.metrics.newGaugeVec(staiServiceFarmer, "harvester_failed_to_open_plots", "Number of plots each harvester failed to open", harvesterLabels)
+	s.harvesterNoKey = s.metrics.newGaugeVec(staiServiceFarmer, "harvester_no_key_plots", "Number of plots on each harvester that don't have a matching key", harvesterLabels)
+	s.harvesterDuplicates = s.metrics.newGaugeVec(staiServiceFarmer, "harvester_duplicate_plots", "Number of duplicate plots on each harvester", harvesterLabels)
+	s.harvesterSyncing = s.metrics.newGaugeVec(staiServiceFarmer, "harvester_plot_sync_active", "Indicates whether the harvester is currently syncing its plot list with the farmer", harvesterLabels)
+	s.harvesterSyncFilesProcessed = s.metrics.newGaugeVec(staiServiceFarmer, "harvester_plot_sync_files_processed", "Number of plot files processed in the current plot sync", harvesterLabels)
+	s.harvesterSyncFilesTotal = s.metrics.newGaugeVec(staiServiceFarmer, "harvester_plot_sync_files_total", "Total number of plot files in the current plot sync", harvesterLabels)
+	s.harvesterLastSyncTime = s.metrics.newGaugeVec(staiServiceFarmer, "harvester_last_plot_sync_timestamp", "Unix timestamp of the last completed plot sync for each harvester", harvesterLabels)
+	s.harvesterPassedFilter = s.metrics.newGaugeVec(staiServiceFarmer, "harvester_last_passed_filter", "Number of plots that passed the filter for the last signage point on each harvester", harvesterLabels)
+	s.harvesterPassedFilterTotal = s.metrics.newCounterVec(staiServiceFarmer, "harvester_passed_filter_total", "Counter of plots that passed the filter on each harvester since the exporter started", harvesterLabels)
+	s.harvesterProofsTotal = s.metrics.newCounterVec(staiServiceFarmer, "harvester_proofs_total", "Counter of proofs found by each harvester since the exporter started", harvesterLabels)
+	s.harvesterLookupTime = s.metrics.newGaugeVec(staiServiceFarmer, "harvester_last_lookup_time", "Lookup time for the last signage point on each harvester, in seconds", harvesterLabels)
+	s.harvesterLastSeen = s.metrics.newGaugeVec(staiServiceFarmer, "harvester_last_seen_timestamp", "Unix timestamp of the last farming info received from each harvester", harvesterLabels)
+
+	s.harvesterHosts = map[string]string{}
 }
 
 // InitialData is called on startup of the metrics server, to allow seeding metrics with current/initial data
 func (s *FarmerServiceMetrics) InitialData() {}
 
+// StartBackgroundTasks polls the farmer for pool state and connected harvesters on the configured intervals
+func (s *FarmerServiceMetrics) StartBackgroundTasks() {
+	startPolling(viper.GetDuration("farmer-pool-state-interval"), s.httpGetPoolState)
+	startPolling(viper.GetDuration("farmer-harvester-summary-interval"), s.httpGetHarvestersSummary)
+}
+
 // Disconnected clears/unregisters metrics when the connection drops
-func (s *FarmerServiceMetrics) Disconnected() {}
+func (s *FarmerServiceMetrics) Disconnected() {
+	s.harvesterPassedFilter.Reset()
+	s.harvesterLookupTime.Reset()
+}
 
 // Reconnected is called when the service is reconnected after the websocket was disconnected
 func (s *FarmerServiceMetrics) Reconnected() {
@@ -56,6 +133,8 @@ func (s *FarmerServiceMetrics) ReceiveResponse(resp *types.WebsocketResponse) {
 		s.SubmittedPartial(resp)
 	case "proof":
 		s.Proof(resp)
+	case "new_farming_info":
+		s.NewFarmingInfo(resp)
 	}
 }
 
@@ -84,3 +163,310 @@ func (s *FarmerServiceMetrics) Proof(resp *types.WebsocketResponse) {
 
 	s.proofsFound.Inc()
 }
+
+// poolStateResponse is the response from get_pool_state on the farmer
+type poolStateResponse struct {
+	Success   bool         `json:"success"`
+	PoolState []*poolState `json:"pool_state"`
+}
+
+// poolState is the state of a single pool the farmer is farming to
+type poolState struct {
+	PoolConfig struct {
+		LauncherID string `json:"launcher_id"`
+		PoolURL    string `json:"pool_url"`
+	} `json:"pool_config"`
+	PointsFound24h        []timestampedPoints `json:"points_found_24h"`
+	PointsAcknowledged24h []timestampedPoints `json:"points_acknowledged_24h"`
+	CurrentDifficulty     *uint64             `json:"current_difficulty"`
+	PoolErrors24h         []poolError         `json:"pool_errors_24h"`
+}
+
+// timestampedPoints is a [timestamp, points] tuple from the pool state
+type timestampedPoints struct {
+	Timestamp float64
+	Points    uint64
+}
+
+// UnmarshalJSON unmarshals the [timestamp, points] tuple into the struct
+func (t *timestampedPoints) UnmarshalJSON(buf []byte) error {
+	tmp := []interface{}{&t.Timestamp, &t.Points}
+	wantLen := len(tmp)
+	if err := json.Unmarshal(buf, &tmp); err != nil {
+		return err
+	}
+	if len(tmp) != wantLen {
+		return fmt.Errorf("wrong number of fields in points tuple: %d != %d", len(tmp), wantLen)
+	}
+	return nil
+}
+
+// poolError is an error returned by the pool
+// Depending on the STAI version, these are either the error itself or a [timestamp, error] tuple
+type poolError struct {
+	ErrorCode    int    `json:"error_code"`
+	ErrorMessage string `json:"error_message"`
+}
+
+// UnmarshalJSON unmarshals either format of pool error
+func (p *poolError) UnmarshalJSON(buf []byte) error {
+	type plainPoolError poolError
+	if len(buf) > 0 && buf[0] == '[' {
+		var timestamp float64
+		tmp := []interface{}{&timestamp, (*plainPoolError)(p)}
+		return json.Unmarshal(buf, &tmp)
+	}
+	return json.Unmarshal(buf, (*plainPoolError)(p))
+}
+
+// httpGetPoolState asks the farmer for the current state of each pool
+func (s *FarmerServiceMetrics) httpGetPoolState() {
+	state := &poolStateResponse{}
+	err := s.metrics.httpRequest(rpcinterface.ServiceFarmer, "get_pool_state", nil, state)
+	if err != nil {
+		// Most installations don't run a farmer, so this is expected to fail often
+		log.Debugf("Could not get pool state from farmer: %s\n", err.Error())
+		return
+	}
+
+	s.ProcessPoolState(state)
+}
+
+// poolErrorLabels are the labels of the pool error count for a single error code
+type poolErrorLabels struct {
+	LauncherID string
+	ErrorCode  string
+}
+
+// ProcessPoolState updates pool metrics from the get_pool_state response
+// Pools can be removed, and error codes drop out of the 24h window, so series that are no longer in the pool state
+// are removed
+func (s *FarmerServiceMetrics) ProcessPoolState(state *poolStateResponse) {
+	poolURLs := map[string]string{}
+	poolErrors := map[poolErrorLabels]bool{}
+	lastPartials := map[string]bool{}
+	for _, pool := range state.PoolState {
+		if pool == nil {
+			continue
+		}
+		launcherID := pool.PoolConfig.LauncherID
+		poolURLs[launcherID] = pool.PoolConfig.PoolURL
+
+		s.poolInfo.WithLabelValues(launcherID, pool.PoolConfig.PoolURL).Set(1)
+
+		pointsFound := uint64(0)
+		for _, points := range pool.PointsFound24h {
+			pointsFound += points.Points
+		}
+		s.pointsFound24h.WithLabelValues(launcherID).Set(float64(pointsFound))
+
+		pointsAck := uint64(0)
+		lastPartial := float64(0)
+		for _, points := range pool.PointsAcknowledged24h {
+			pointsAck += points.Points
+			if points.Timestamp > lastPartial {
+				lastPartial = points.Timestamp
+			}
+		}
+		s.pointsAck24h.WithLabelValues(launcherID).Set(float64(pointsAck))
+		if lastPartial > 0 {
+			s.lastPartialTimestamp.WithLabelValues(launcherID).Set(lastPartial)
+			lastPartials[launcherID] = true
+		}
+
+		if pool.CurrentDifficulty != nil {
+			s.currentDifficulty.WithLabelValues(launcherID).Set(float64(*pool.CurrentDifficulty))
+		}
+
+		errorCounts := map[int]float64{}
+		for _, poolErr := range pool.PoolErrors24h {
+			errorCounts[poolErr.ErrorCode]++
+		}
+		for code, count := range errorCounts {
+			labels := poolErrorLabels{LauncherID: launcherID, ErrorCode: fmt.Sprintf("%d", code)}
+			s.poolErrors24h.WithLabelValues(labels.LauncherID, labels.ErrorCode).Set(count)
+			poolErrors[labels] = true
+		}
+	}
+
+	for launcherID, poolURL := range s.poolURLs {
+		newURL, ok := poolURLs[launcherID]
+		if !ok || newURL != poolURL {
+			s.poolInfo.DeleteLabelValues(launcherID, poolURL)
+		}
+		if !ok {
+			s.pointsFound24h.DeleteLabelValues(launcherID)
+			s.pointsAck24h.DeleteLabelValues(launcherID)
+		}
+	}
+	for launcherID := range s.lastPartials {
+		if !lastPartials[launcherID] {
+			s.lastPartialTimestamp.DeleteLabelValues(launcherID)
+		}
+	}
+	for labels := range s.poolErrors {
+		if !poolErrors[labels] {
+			s.poolErrors24h.DeleteLabelValues(labels.LauncherID, labels.ErrorCode)
+		}
+	}
+	s.poolURLs = poolURLs
+	s.poolErrors = poolErrors
+	s.lastPartials = lastPartials
+}
+
+// farmerFarmingInfoEvent is the new_farming_info event from the farmer, sent for each signage point a harvester responds to
+type farmerFarmingInfoEvent struct {
+	FarmingInfo struct {
+		ChallengeHash string  `json:"challenge_hash"`
+		SignagePoint  string  `json:"signage_point"`
+		PassedFilter  uint64  `json:"passed_filter"`
+		Proofs        uint64  `json:"proofs"`
+		TotalPlots    uint64  `json:"total_plots"`
+		Timestamp     float64 `json:"timestamp"`
+		NodeID        string  `json:"node_id"`
+		LookupTime    float64 `json:"lookup_time"`
+	} `json:"farming_info"`
+}
+
+// NewFarmingInfo handles the new_farming_info event from the farmer
+func (s *FarmerServiceMetrics) NewFarmingInfo(resp *types.WebsocketResponse) {
+	info := &farmerFarmingInfoEvent{}
+	err := json.Unmarshal(resp.Data, info)
+	if err != nil {
+		log.Errorf("Error unmarshalling: %s\n", err.Error())
+		return
+	}
+
+	nodeID := info.FarmingInfo.NodeID
+
+	// The lock is held while the metrics are set, so the summary can't remove the series for the old host in between
+	s.harvesterHostsLock.Lock()
+	host, ok := s.harvesterHosts[nodeID]
+	if !ok {
+		// New harvester we don't know the host for yet. Don't ask again for every event. The host is filled in once the
+		// summary is received, and the series without a host are removed then
+		s.harvesterHosts[nodeID] = ""
+	}
+
+	s.harvesterPlots.WithLabelValues(nodeID, host).Set(float64(info.FarmingInfo.TotalPlots))
+	s.harvesterPassedFilter.WithLabelValues(nodeID, host).Set(float64(info.FarmingInfo.PassedFilter))
+	s.harvesterPassedFilterTotal.WithLabelValues(nodeID, host).Add(float64(info.FarmingInfo.PassedFilter))
+	s.harvesterProofsTotal.WithLabelValues(nodeID, host).Add(float64(info.FarmingInfo.Proofs))
+	s.harvesterLastSeen.WithLabelValues(nodeID, host).Set(info.FarmingInfo.Timestamp)
+	// lookup_time is not present in older versions of STAI
+	if info.FarmingInfo.LookupTime > 0 {
+		s.harvesterLookupTime.WithLabelValues(nodeID, host).Set(info.FarmingInfo.LookupTime)
+	}
+	s.harvesterHostsLock.Unlock()
+
+	if !ok {
+		s.requestHarvestersSummary()
+	}
+}
+
+// requestHarvestersSummary asks the farmer for a harvester summary in the background, so websocket events aren't
+// held up by the request. Only one summary is requested at a time
+func (s *FarmerServiceMetrics) requestHarvestersSummary() {
+	if !atomic.CompareAndSwapInt32(&s.summaryInProgress, 0, 1) {
+		log.Debugln("Harvester summary request is already in progress, skipping")
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&s.summaryInProgress, 0)
+		s.httpGetHarvestersSummary()
+	}()
+}
+
+// harvestersSummaryResponse is the response from get_harvesters_summary on the farmer
+type harvestersSummaryResponse struct {
+	Success    bool                `json:"success"`
+	Harvesters []*harvesterSummary `json:"harvesters"`
+}
+
+// harvesterSummary is the summary of a single harvester connected to the farmer
+type harvesterSummary struct {
+	Connection struct {
+		NodeID string `json:"node_id"`
+		Host   string `json:"host"`
+		Port   uint16 `json:"port"`
+	} `json:"connection"`
+	Plots                 uint64  `json:"plots"`
+	FailedToOpenFilenames uint64  `json:"failed_to_open_filenames"`
+	NoKeyFilenames        uint64  `json:"no_key_filenames"`
+	Duplicates            uint64  `json:"duplicates"`
+	TotalPlotSize         uint64  `json:"total_plot_size"`
+	LastSyncTime          float64 `json:"last_sync_time"`
+	Syncing               *struct {
+		Initial            bool   `json:"initial"`
+		PlotFilesProcessed uint64 `json:"plot_files_processed"`
+		PlotFilesTotal     uint64 `json:"plot_files_total"`
+	} `json:"syncing"`
+}
+
+// httpGetHarvestersSummary asks the farmer for a summary of all connected harvesters
+func (s *FarmerServiceMetrics) httpGetHarvestersSummary() {
+	summary := &harvestersSummaryResponse{}
+	err := s.metrics.httpRequest(rpcinterface.ServiceFarmer, "get_harvesters_summary", nil, summary)
+	if err != nil {
+		// Most installations don't run a farmer, so this is expected to fail often
+		log.Debugf("Could not get harvesters summary from farmer: %s\n", err.Error())
+		return
+	}
+
+	s.ProcessHarvestersSummary(summary)
+}
+
+// ProcessHarvestersSummary updates per-harvester metrics from the get_harvesters_summary response
+func (s *FarmerServiceMetrics) ProcessHarvestersSummary(summary *harvestersSummaryResponse) {
+	hosts := map[string]string{}
+	for _, harvester := range summary.Harvesters {
+		if harvester == nil {
+			continue
+		}
+		nodeID := harvester.Connection.NodeID
+		host := harvester.Connection.Host
+		hosts[nodeID] = host
+
+		s.harvesterPlots.WithLabelValues(nodeID, host).Set(float64(harvester.Plots))
+		s.harvesterPlotSize.WithLabelValues(nodeID, host).Set(float64(harvester.TotalPlotSize))
+		s.harvesterFailedToOpen.WithLabelValues(nodeID, host).Set(float64(harvester.FailedToOpenFilenames))
+		s.harvesterNoKey.WithLabelValues(nodeID, host).Set(float64(harvester.NoKeyFilenames))
+		s.harvesterDuplicates.WithLabelValues(nodeID, host).Set(float64(harvester.Duplicates))
+		s.harvesterLastSyncTime.WithLabelValues(nodeID, host).Set(harvester.LastSyncTime)
+		if harvester.Syncing != nil {
+			s.harvesterSyncing.WithLabelValues(nodeID, host).Set(1)
+			s.harvesterSyncFilesProcessed.WithLabelValues(nodeID, host).Set(float64(harvester.Syncing.PlotFilesProcessed))
+			s.harvesterSyncFilesTotal.WithLabelValues(nodeID, host).Set(float64(harvester.Syncing.PlotFilesTotal))
+		} else {
+			s.harvesterSyncing.WithLabelValues(nodeID, host).Set(0)
+			s.harvesterSyncFilesProcessed.DeleteLabelValues(nodeID, host)
+			s.harvesterSyncFilesTotal.DeleteLabelValues(nodeID, host)
+		}
+	}
+
+	// Stop reporting harvesters that are no longer connected, or have changed hosts
+	s.harvesterHostsLock.Lock()
+	defer s.harvesterHostsLock.Unlock()
+	for nodeID, host := range s.harvesterHosts {
+		if newHost, ok := hosts[nodeID]; ok && newHost == host {
+			continue
+		}
+		labels := prometheus.Labels{"node_id": nodeID, "host": host}
+		s.harvesterPlots.Delete(labels)
+		s.harvesterPlotSize.Delete(labels)
+		s.harvesterFailedToOpen.Delete(labels)
+		s.harvesterNoKey.Delete(labels)
+		s.harvesterDuplicates.Delete(labels)
+		s.harvesterSyncing.Delete(labels)
+		s.harvesterSyncFilesProcessed.Delete(labels)
+		s.harvesterSyncFilesTotal.Delete(labels)
+		s.harvesterLastSyncTime.Delete(labels)
+		s.harvesterPassedFilter.Delete(labels)
+		s.harvesterPassedFilterTotal.Delete(labels)
+		s.harvesterProofsTotal.Delete(labels)
+		s.harvesterLookupTime.Delete(labels)
+		s.harvesterLastSeen.Delete(labels)
+	}
+	s.harvesterHosts = hosts
+}
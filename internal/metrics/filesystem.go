@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/forks-lab/go-stai-libs/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Metrics about the filesystems STAI stores plots and databases on are in this file
+
+// filesystemStats is the capacity information for a single filesystem
+type filesystemStats struct {
+	MountPoint string
+	SizeBytes  uint64
+	FreeBytes  uint64
+	AvailBytes uint64
+	Inodes     uint64
+	InodesFree uint64
+	ReadOnly   bool
+}
+
+// FilesystemMetrics contains metrics about the filesystems used by the harvester and full node
+// These are not based on any RPC, so are refreshed on an interval in the background
+type FilesystemMetrics struct {
+	// Holds a reference to the main metrics container this is a part of
+	metrics *Metrics
+
+	// The mount points and plot directories reported by the last refresh, so ones that are no longer used can be
+	// removed. Only used by the polling goroutine
+	mountPoints     map[string]bool
+	plotDirectories map[string]bool
+
+	// Capacity Metrics, by mount point
+	sizeBytes  *prometheus.GaugeVec
+	freeBytes  *prometheus.GaugeVec
+	availBytes *prometheus.GaugeVec
+	usedBytes  *prometheus.GaugeVec
+	inodes     *prometheus.GaugeVec
+	inodesFree *prometheus.GaugeVec
+	inodesUsed *prometheus.GaugeVec
+
+	// Plot Directory Metrics, by configured path
+	plotDirectoryMissing  *prometheus.GaugeVec
+	plotDirectoryReadOnly *prometheus.GaugeVec
+}
+
+// InitMetrics sets all the metrics properties
+func (s *FilesystemMetrics) InitMetrics() {
+	fsLabels := []string{"mountpoint"}
+	s.sizeBytes = s.metrics.newGaugeVec(staiServiceFilesystem, "size_bytes", "Total size of the filesystem, in bytes", fsLabels)
+	s.freeBytes = s.metrics.newGaugeVec(staiServiceFilesystem, "free_bytes", "Free space on the filesystem, in bytes, including space reserved for root", fsLabels)
+	s.availBytes = s.metrics.newGaugeVec(staiServiceFilesystem, "avail_bytes", "Free space on the filesystem available to non-root users, in bytes", fsLabels)
+	s.usedBytes = s.metrics.newGaugeVec(staiServiceFilesystem, "used_bytes", "Used space on the filesystem, in bytes", fsLabels)
+	s.inodes = s.metrics.newGaugeVec(staiServiceFilesystem, "inodes", "Total number of inodes on the filesystem", fsLabels)
+	s.inodesFree = s.metrics.newGaugeVec(staiServiceFilesystem, "inodes_free", "Number of free inodes on the filesystem", fsLabels)
+	s.inodesUsed = s.metrics.newGaugeVec(staiServiceFilesystem, "inodes_used", "Number of used inodes on the filesystem", fsLabels)
+
+	plotDirLabels := []string{"path"}
+	s.plotDirectoryMissing = s.metrics.newGaugeVec(staiServiceFilesystem, "plot_directory_missing", "Indicates a plot directory from the harvester config does not exist, such as when a disk is not mounted", plotDirLabels)
+	s.plotDirectoryReadOnly = s.metrics.newGaugeVec(staiServiceFilesystem, "plot_directory_read_only", "Indicates a plot directory from the harvester config is on a read-only filesystem", plotDirLabels)
+}
+
+// StartBackgroundTasks refreshes filesystem metrics on the configured interval for the lifetime of the process
+func (s *FilesystemMetrics) StartBackgroundTasks() {
+	interval := viper.GetDuration("filesystem-refresh-interval")
+	if interval <= 0 {
+		log.Info("Filesystem metrics are disabled")
+		return
+	}
+	if !statfsSupported {
+		log.Info("Filesystem metrics are not supported on this platform")
+		return
+	}
+
+	startPolling(interval, s.RefreshFilesystems)
+}
+
+// RefreshFilesystems checks the capacity of the filesystems that hold plots and the full node database
+func (s *FilesystemMetrics) RefreshFilesystems() {
+	log.Info("cron: updating filesystem usage")
+	cfg, err := config.GetStaiConfig()
+	if err != nil {
+		log.Errorf("Error getting STAI config: %s\n", err.Error())
+		return
+	}
+	v, err := readStaiConfigFile(cfg)
+	if err != nil {
+		log.Errorf("Error reading STAI config file: %s\n", err.Error())
+		return
+	}
+
+	filesystems := map[string]*filesystemStats{}
+
+	// The database file may not exist yet, but the directory it will be created in is still relevant
+	database := staiPath(cfg, cfg.FullNode.DatabasePath)
+	if stats, err := statFilesystem(filepath.Dir(database)); err == nil {
+		filesystems[stats.MountPoint] = stats
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("Error getting filesystem info for %s: %s\n", database, err.Error())
+	}
+
+	plotDirectories := map[string]bool{}
+	for _, plotDir := range v.GetStringSlice("harvester.plot_directories") {
+		stats, err := statFilesystem(staiPath(cfg, plotDir))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				plotDirectories[plotDir] = true
+				s.plotDirectoryMissing.WithLabelValues(plotDir).Set(1)
+				s.plotDirectoryReadOnly.WithLabelValues(plotDir).Set(0)
+				continue
+			}
+			log.Errorf("Error getting filesystem info for %s: %s\n", plotDir, err.Error())
+			continue
+		}
+
+		filesystems[stats.MountPoint] = stats
+		plotDirectories[plotDir] = true
+		s.plotDirectoryMissing.WithLabelValues(plotDir).Set(0)
+		if stats.ReadOnly {
+			s.plotDirectoryReadOnly.WithLabelValues(plotDir).Set(1)
+		} else {
+			s.plotDirectoryReadOnly.WithLabelValues(plotDir).Set(0)
+		}
+	}
+
+	// Plot directories that were removed from the config, or can't be checked, stop reporting
+	for plotDir := range s.plotDirectories {
+		if !plotDirectories[plotDir] {
+			s.plotDirectoryMissing.DeleteLabelValues(plotDir)
+			s.plotDirectoryReadOnly.DeleteLabelValues(plotDir)
+		}
+	}
+	s.plotDirectories = plotDirectories
+
+	// Filesystems that are no longer used (unmounted disks, removed plot directories) stop reporting
+	for mount := range s.mountPoints {
+		if _, ok := filesystems[mount]; !ok {
+			s.sizeBytes.DeleteLabelValues(mount)
+			s.freeBytes.DeleteLabelValues(mount)
+			s.availBytes.DeleteLabelValues(mount)
+			s.usedBytes.DeleteLabelValues(mount)
+			s.inodes.DeleteLabelValues(mount)
+			s.inodesFree.DeleteLabelValues(mount)
+			s.inodesUsed.DeleteLabelValues(mount)
+		}
+	}
+	s.mountPoints = map[string]bool{}
+	for mount, stats := range filesystems {
+		s.sizeBytes.WithLabelValues(mount).Set(float64(stats.SizeBytes))
+		s.freeBytes.WithLabelValues(mount).Set(float64(stats.FreeBytes))
+		s.availBytes.WithLabelValues(mount).Set(float64(stats.AvailBytes))
+		s.usedBytes.WithLabelValues(mount).Set(float64(stats.SizeBytes - stats.FreeBytes))
+		s.inodes.WithLabelValues(mount).Set(float64(stats.Inodes))
+		s.inodesFree.WithLabelValues(mount).Set(float64(stats.InodesFree))
+		s.inodesUsed.WithLabelValues(mount).Set(float64(stats.Inodes - stats.InodesFree))
+		s.mountPoints[mount] = true
+	}
+}
@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/forks-lab/go-stai-libs/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	wrappedPrometheus "github.com/forks-lab/stai-exporter/internal/prometheus"
+)
+
+// Metrics about the size of files and directories are in this file
+
+// watchedPath is a file or directory to report the size of
+type watchedPath struct {
+	// Name is used as a label to identify the path. Defaults to the path
+	Name string `mapstructure:"name"`
+
+	// Path may be absolute or relative to STAI_ROOT
+	Path string `mapstructure:"path"`
+
+	// Interval overrides file-watch-interval for this path
+	Interval time.Duration `mapstructure:"interval"`
+
+	// Recursive includes the files in all subdirectories in the size of a directory
+	Recursive bool `mapstructure:"recursive"`
+
+	// gauge is set instead of the labeled metrics, for sizes that were reported before paths were configurable
+	gauge *wrappedPrometheus.LazyGauge
+}
+
+// FileWatcherMetrics reports the size of configured files and directories
+// These are not based on any RPC, so are refreshed on an interval in the background
+type FileWatcherMetrics struct {
+	// Holds a reference to the main metrics container this is a part of
+	metrics *Metrics
+
+	// Paths added by services before the watcher is started
+	lock  sync.Mutex
+	paths []*watchedPath
+
+	// Size Metrics, by name and path
+	sizeBytes *prometheus.GaugeVec
+	fileCount *prometheus.GaugeVec
+	exists    *prometheus.GaugeVec
+}
+
+// InitMetrics sets all the metrics properties
+func (s *FileWatcherMetrics) InitMetrics() {
+	labels := []string{"name", "path"}
+	s.sizeBytes = s.metrics.newGaugeVec(staiServiceFiles, "size_bytes", "Size of the file, or the total size of the files in the directory, in bytes", labels)
+	s.fileCount = s.metrics.newGaugeVec(staiServiceFiles, "file_count", "Number of files in the directory", labels)
+	s.exists = s.metrics.newGaugeVec(staiServiceFiles, "exists", "Indicates whether the file or directory exists", labels)
+}
+
+// Watch adds a path to report the size of. Must be called before StartBackgroundTasks
+func (s *FileWatcherMetrics) Watch(path *watchedPath) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.paths = append(s.paths, path)
+}
+
+// StartBackgroundTasks starts refreshing the size of every watched path on its interval, for the lifetime of the
+// process. Paths that share an interval are refreshed together
+func (s *FileWatcherMetrics) StartBackgroundTasks() {
+	var configured []*watchedPath
+	err := viper.UnmarshalKey("file-watch", &configured)
+	if err != nil {
+		log.Errorf("Error reading file-watch config: %s\n", err.Error())
+	}
+
+	cfg, err := config.GetStaiConfig()
+	if err != nil {
+		log.Errorf("Error getting STAI config: %s\n", err.Error())
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	defaultInterval := viper.GetDuration("file-watch-interval")
+	byInterval := map[time.Duration][]*watchedPath{}
+	for _, path := range append(s.paths, configured...) {
+		if path == nil || path.Path == "" {
+			continue
+		}
+		if cfg != nil {
+			path.Path = staiPath(cfg, path.Path)
+		}
+		if path.Name == "" {
+			path.Name = path.Path
+		}
+		interval := path.Interval
+		if interval <= 0 {
+			interval = defaultInterval
+		}
+		if interval <= 0 {
+			continue
+		}
+		byInterval[interval] = append(byInterval[interval], path)
+	}
+
+	for interval, paths := range byInterval {
+		paths := paths
+		startPolling(interval, func() {
+			for _, path := range paths {
+				s.RefreshPath(path)
+			}
+		})
+	}
+}
+
+// RefreshPath updates the size metrics for a single path
+func (s *FileWatcherMetrics) RefreshPath(path *watchedPath) {
+	log.Debugf("file: getting size of %s\n", path.Path)
+	size, files, isDir, err := pathSize(path.Path, path.Recursive)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Error getting size of %s: %s\n", path.Path, err.Error())
+			return
+		}
+
+		log.Debugf("file: file doesn't exist: %s\n", path.Path)
+		if path.gauge != nil {
+			path.gauge.Unregister()
+			return
+		}
+		s.sizeBytes.DeleteLabelValues(path.Name, path.Path)
+		s.fileCount.DeleteLabelValues(path.Name, path.Path)
+		s.exists.WithLabelValues(path.Name, path.Path).Set(0)
+		return
+	}
+
+	if path.gauge != nil {
+		path.gauge.Set(float64(size))
+		return
+	}
+	s.exists.WithLabelValues(path.Name, path.Path).Set(1)
+	s.sizeBytes.WithLabelValues(path.Name, path.Path).Set(float64(size))
+	if isDir {
+		s.fileCount.WithLabelValues(path.Name, path.Path).Set(float64(files))
+	}
+}
+
+// pathSize returns the size of a file, or the total size and number of files in a directory
+func pathSize(path string, recursive bool) (size int64, files int64, isDir bool, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if !info.IsDir() {
+		return info.Size(), 1, false, nil
+	}
+
+	err = filepath.WalkDir(path, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Files can be removed while walking, which is fine
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			if current != path && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		entryInfo, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entryInfo.Mode().IsRegular() {
+			size += entryInfo.Size()
+			files++
+		}
+		return nil
+	})
+
+	return size, files, true, err
+}
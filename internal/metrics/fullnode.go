@@ -2,17 +2,19 @@ package metrics
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"os"
+	"math/big"
+	"sync/atomic"
 	"time"
 
 	"github.com/forks-lab/go-stai-libs/pkg/config"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/forks-lab/go-stai-libs/pkg/rpc"
+	"github.com/forks-lab/go-stai-libs/pkg/rpcinterface"
 	"github.com/forks-lab/go-stai-libs/pkg/types"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
 
 	wrappedPrometheus "github.com/forks-lab/stai-exporter/internal/prometheus"
 	"github.com/forks-lab/stai-exporter/internal/utils"
@@ -36,6 +38,14 @@ type FullNodeServiceMetrics struct {
 	nodeHeightSynced    *wrappedPrometheus.LazyGauge
 	nodeSynced          *wrappedPrometheus.LazyGauge
 
+	// Sync Progress Metrics
+	syncProgress       syncTracker
+	syncTipHeight      *wrappedPrometheus.LazyGauge
+	syncProgressHeight *wrappedPrometheus.LazyGauge
+	blocksBehind       *wrappedPrometheus.LazyGauge
+	syncRate           *wrappedPrometheus.LazyGauge
+	syncTimeRemaining  *wrappedPrometheus.LazyGauge
+
 	// BlockCount Metrics
 	compactBlocks   *wrappedPrometheus.LazyGauge
 	uncompactBlocks *wrappedPrometheus.LazyGauge
@@ -44,6 +54,16 @@ type FullNodeServiceMetrics struct {
 	// Connection Metrics
 	connectionCount *prometheus.GaugeVec
 
+	// Peer Metrics
+	peerCount              *prometheus.GaugeVec
+	peerBytesRead          *prometheus.GaugeVec
+	peerBytesWritten       *prometheus.GaugeVec
+	peerPeakHeight         *prometheus.GaugeVec
+	peerConnectedSeconds   *prometheus.GaugeVec
+	peerLastMessageSeconds *prometheus.GaugeVec
+	// peerGroups are the peer labels currently reported, so groups that disappear can be removed
+	peerGroups map[string]bool
+
 	// Block Metrics
 	maxBlockCost      *wrappedPrometheus.LazyGauge
 	blockCost         *wrappedPrometheus.LazyGauge
@@ -52,11 +72,50 @@ type FullNodeServiceMetrics struct {
 	preValidationTime *wrappedPrometheus.LazyGauge
 	validationTime    *wrappedPrometheus.LazyGauge
 
+	// Timing Metrics
+	timer                    eventTimer
+	blockInterval            prometheus.Histogram
+	transactionBlockInterval prometheus.Histogram
+	signagePointInterval     prometheus.Histogram
+
+	// Reorg Metrics
+	peaks      peakTracker
+	reorgs     *wrappedPrometheus.LazyCounter
+	reorgDepth prometheus.Histogram
+
+	// Throughput Metrics
+	transactionBlocks     chan string
+	blockCoinsCreated     *wrappedPrometheus.LazyGauge
+	blockCoinsSpent       *wrappedPrometheus.LazyGauge
+	blockAmountMoved      *wrappedPrometheus.LazyGauge
+	transactionsPerSecond prometheus.Histogram
+	spendsPerBlock        prometheus.Histogram
+
 	// Signage Point Metrics
 	totalSignagePoints   *wrappedPrometheus.LazyCounter
 	signagePointsSubSlot *wrappedPrometheus.LazyGauge
 	currentSignagePoint  *wrappedPrometheus.LazyGauge
 
+	// Fee Estimate Metrics
+	feeEstimate           *prometheus.GaugeVec
+	feeRateEstimate       *prometheus.GaugeVec
+	currentFeeRate        *wrappedPrometheus.LazyGauge
+	mempoolFeeRatePercent *prometheus.GaugeVec
+
+	// Mempool Metrics
+	mempoolNextFetch    time.Time
+	peakHeight          uint32
+	mempoolFeePerCost   *wrappedPrometheus.SnapshotHistogram
+	mempoolItemCost     *wrappedPrometheus.SnapshotHistogram
+	mempoolItemAge      *wrappedPrometheus.SnapshotHistogram
+	mempoolZeroFeeItems *wrappedPrometheus.LazyGauge
+	mempoolTotalFees    *wrappedPrometheus.LazyGauge
+
+	// Watch-Only Address Metrics
+	watchAddressBalance      *prometheus.GaugeVec
+	watchAddressUnspentCoins *prometheus.GaugeVec
+	watchAddressLastReceived *prometheus.GaugeVec
+
 	// Filesize Metrics
 	database          *wrappedPrometheus.LazyGauge
 	databaseWal       *wrappedPrometheus.LazyGauge
@@ -79,6 +138,9 @@ func (s *FullNodeServiceMetrics) InitMetrics() {
 	s.nodeHeightSynced = s.metrics.newGauge(staiServiceFullNode, "node_height_synced", "Current height of the node, when synced. This will register/unregister automatically depending on sync state, and should help make rate() more sane, when you don't want rate of syncing, only rate of the chain.")
 	s.nodeSynced = s.metrics.newGauge(staiServiceFullNode, "node_synced", "Indicates whether this node is currently synced")
 
+	// Sync Progress Metrics
+	s.initSyncMetrics()
+
 	// BlockCount Metrics
 	s.compactBlocks = s.metrics.newGauge(staiServiceFullNode, "compact_blocks", "Number of fully compact blocks in this node's database")
 	s.uncompactBlocks = s.metrics.newGauge(staiServiceFullNode, "uncompact_blocks", "Number of uncompact blocks in this node's database")
@@ -87,6 +149,9 @@ func (s *FullNodeServiceMetrics) InitMetrics() {
 	// Connection Metrics
 	s.connectionCount = s.metrics.newGaugeVec(staiServiceFullNode, "connection_count", "Number of active connections for each type of peer", []string{"node_type"})
 
+	// Peer Metrics
+	s.initPeerMetrics()
+
 	// Unfinished Block Metrics
 	s.maxBlockCost = s.metrics.newGauge(staiServiceFullNode, "block_max_cost", "Max block size, in cost")
 	s.blockCost = s.metrics.newGauge(staiServiceFullNode, "block_cost", "Total cost of all transactions in the last block")
@@ -95,11 +160,34 @@ func (s *FullNodeServiceMetrics) InitMetrics() {
 	s.preValidationTime = s.metrics.newGauge(staiServiceFullNode, "pre_validation_time", "Last pre_validation_time from the block event")
 	s.validationTime = s.metrics.newGauge(staiServiceFullNode, "validation_time", "Last validation time from the block event")
 
+	// Timing Metrics
+	s.initTimingMetrics()
+
+	// Throughput Metrics
+	s.initThroughputMetrics()
+
+	// Reorg Metrics
+	s.reorgs = s.metrics.newCounter(staiServiceFullNode, "reorgs_total", "Number of chain reorganizations seen since the exporter was last started")
+	s.reorgDepth = s.metrics.newHistogram(staiServiceFullNode, "reorg_depth", "Number of blocks removed from the chain by each reorganization", reorgDepthBuckets)
+
 	// Signage Point Metrics
 	s.totalSignagePoints = s.metrics.newCounter(staiServiceFullNode, "total_signage_points", "Total number of signage points since the metrics exporter started. Only useful when combined with rate() or similar")
 	s.signagePointsSubSlot = s.metrics.newGauge(staiServiceFullNode, "signage_points_sub_slot", "Number of signage points per sub slot")
 	s.currentSignagePoint = s.metrics.newGauge(staiServiceFullNode, "current_signage_point", "Index of the last signage point received")
 
+	// Fee Estimate Metrics
+	feeLabels := []string{"cost", "target_seconds"}
+	s.feeEstimate = s.metrics.newGaugeVec(staiServiceFullNode, "fee_estimate", "Estimated fee, in mojos, for a transaction of this cost to be included within the target time", feeLabels)
+	s.feeRateEstimate = s.metrics.newGaugeVec(staiServiceFullNode, "fee_rate_estimate", "Estimated fee per cost for a transaction of this cost to be included within the target time", feeLabels)
+	s.currentFeeRate = s.metrics.newGauge(staiServiceFullNode, "mempool_current_fee_rate", "Current fee rate of the mempool, in fee per cost, as reported by the fee estimator")
+	s.mempoolFeeRatePercent = s.metrics.newGaugeVec(staiServiceFullNode, "mempool_fee_rate_percentile", "Fee per cost of the items in the mempool at each percentile", []string{"percentile"})
+
+	// Mempool Metrics
+	s.initMempoolMetrics()
+
+	// Watch-Only Address Metrics
+	s.initWatchOnlyMetrics()
+
 	// File Size Metrics
 	s.database = s.metrics.newGauge(staiServiceFullNode, "database_filesize", "Size of the database file")
 	s.databaseWal = s.metrics.newGauge(staiServiceFullNode, "database_wal_filesize", "Size of the database wal file")
@@ -115,14 +203,6 @@ func (s *FullNodeServiceMetrics) InitialData() {
 	// Ask for some initial data so we dont have to wait as long
 	utils.LogErr(s.metrics.client.FullNodeService.GetBlockchainState()) // Also calls get_connections once we get the response
 	utils.LogErr(s.metrics.client.FullNodeService.GetBlockCountMetrics())
-
-	// Things that update in the background
-	go func() {
-		for {
-			s.RefreshFileSizes()
-			time.Sleep(30 * time.Second)
-		}
-	}()
 }
 
 // Disconnected clears/unregisters metrics when the connection drops
@@ -136,21 +216,61 @@ func (s *FullNodeServiceMetrics) Disconnected() {
 	s.nodeHeight.Unregister()
 	s.nodeHeightSynced.Unregister()
 	s.nodeSynced.Unregister()
+	s.unregisterSyncMetrics()
 
 	s.compactBlocks.Unregister()
 	s.uncompactBlocks.Unregister()
 	s.hintCount.Unregister()
 
 	s.connectionCount.Reset()
+	s.resetPeerMetrics()
 
 	s.maxBlockCost.Unregister()
 	s.blockCost.Unregister()
 	s.blockFees.Unregister()
 	s.kSize.Reset()
+	s.peaks.setSynced(false)
+	s.resetTiming()
+	s.unregisterThroughputMetrics()
 
 	s.totalSignagePoints.Unregister()
 	s.signagePointsSubSlot.Unregister()
 	s.currentSignagePoint.Unregister()
+
+	s.feeEstimate.Reset()
+	s.feeRateEstimate.Reset()
+	s.currentFeeRate.Unregister()
+
+	s.unregisterMempoolMetrics()
+	s.resetWatchOnlyMetrics()
+}
+
+// StartBackgroundTasks polls the full node for fee estimates, mempool contents, and watch-only address balances on
+// the configured intervals, starts fetching the coins in each transaction block, and watches the size of the
+// database files
+func (s *FullNodeServiceMetrics) StartBackgroundTasks() {
+	startPolling(viper.GetDuration("fee-estimate-interval"), s.RefreshFeeEstimates)
+	startPolling(viper.GetDuration("mempool-refresh-interval"), s.RefreshMempool)
+	go s.processTransactionBlocks()
+	s.watchAddresses()
+	s.watchFiles()
+}
+
+// watchFiles adds the full node database and related files to the file watcher
+func (s *FullNodeServiceMetrics) watchFiles() {
+	cfg, err := config.GetStaiConfig()
+	if err != nil {
+		log.Errorf("Error getting STAI config: %s\n", err.Error())
+		return
+	}
+
+	database := cfg.GetFullPath(cfg.FullNode.DatabasePath)
+	s.metrics.fileWatcher.Watch(&watchedPath{Path: database, gauge: s.database})
+	s.metrics.fileWatcher.Watch(&watchedPath{Path: fmt.Sprintf("%s-wal", database), gauge: s.databaseWal})
+	s.metrics.fileWatcher.Watch(&watchedPath{Path: fmt.Sprintf("%s-shm", database), gauge: s.databaseShm})
+	s.metrics.fileWatcher.Watch(&watchedPath{Path: cfg.GetFullPath("db/height-to-hash"), gauge: s.heightToHash})
+	s.metrics.fileWatcher.Watch(&watchedPath{Path: cfg.GetFullPath("db/peers.dat"), gauge: s.peersDat})
+	s.metrics.fileWatcher.Watch(&watchedPath{Path: cfg.GetFullPath("db/sub-epoch-summaries"), gauge: s.subEpochSummaries})
 }
 
 // Reconnected is called when the service is reconnected after the websocket was disconnected
@@ -164,13 +284,20 @@ func (s *FullNodeServiceMetrics) ReceiveResponse(resp *types.WebsocketResponse)
 	case "get_blockchain_state":
 		s.GetBlockchainState(resp)
 		// Ask for connection info when we get updated blockchain state
-		utils.LogErr(s.metrics.client.FullNodeService.GetConnections(&rpc.GetConnectionsOptions{}))
+		s.metrics.scheduler.Request("get_connections", "get_connections", func() error {
+			_, _, err := s.metrics.client.FullNodeService.GetConnections(&rpc.GetConnectionsOptions{})
+			return err
+		})
 	case "block":
 		s.Block(resp)
 		// Ask for block count metrics when we get a new block
-		utils.LogErr(s.metrics.client.FullNodeService.GetBlockCountMetrics())
+		s.metrics.scheduler.Request("get_block_count_metrics", "get_block_count_metrics", func() error {
+			_, _, err := s.metrics.client.FullNodeService.GetBlockCountMetrics()
+			return err
+		})
 	case "get_connections":
 		s.GetConnections(resp)
+		s.GetPeerConnections(resp)
 	case "get_block_count_metrics":
 		s.GetBlockCountMetrics(resp)
 	case "signage_point":
@@ -193,9 +320,13 @@ func (s *FullNodeServiceMetrics) GetBlockchainState(resp *types.WebsocketRespons
 		} else {
 			s.nodeSynced.Set(0)
 		}
+		s.peaks.setSynced(state.BlockchainState.Sync.Synced)
+		s.ProcessSyncState(state.BlockchainState.Sync, state.BlockchainState.Peak)
 	}
 
 	if state.BlockchainState.Peak != nil {
+		s.TrackPeak(state.BlockchainState.Peak.Height, state.BlockchainState.Peak.HeaderHash, state.BlockchainState.Peak.PrevHash)
+		atomic.StoreUint32(&s.peakHeight, state.BlockchainState.Peak.Height)
 		s.nodeHeight.Set(float64(state.BlockchainState.Peak.Height))
 		if state.BlockchainState.Sync.Synced {
 			s.nodeHeightSynced.Set(float64(state.BlockchainState.Peak.Height))
@@ -209,6 +340,8 @@ func (s *FullNodeServiceMetrics) GetBlockchainState(resp *types.WebsocketRespons
 	if MiB.FitsInUint64() {
 		s.netspaceMiB.Set(float64(MiB.Uint64()))
 	}
+	spaceBytes, _ := new(big.Float).SetInt(space.Big()).Float64()
+	s.metrics.estimateMetrics.SetNetspace(spaceBytes)
 	s.difficulty.Set(float64(state.BlockchainState.Difficulty))
 	s.mempoolSize.Set(float64(state.BlockchainState.MempoolSize))
 	s.mempoolCost.Set(float64(state.BlockchainState.MempoolCost))
@@ -271,6 +404,8 @@ func (s *FullNodeServiceMetrics) Block(resp *types.WebsocketResponse) {
 		return
 	}
 
+	s.TrackPeak(block.Height, block.HeaderHash, "")
+	s.recordBlockTiming(block.TransactionBlock)
 	s.kSize.WithLabelValues(fmt.Sprintf("%d", block.KSize)).Inc()
 	s.preValidationTime.Set(block.PreValidationTime)
 	s.validationTime.Set(block.ValidationTime)
@@ -278,6 +413,7 @@ func (s *FullNodeServiceMetrics) Block(resp *types.WebsocketResponse) {
 	if block.TransactionBlock {
 		s.blockCost.Set(float64(block.BlockCost))
 		s.blockFees.Set(float64(block.BlockFees))
+		s.queueTransactionBlock(block.HeaderHash)
 	}
 }
 
@@ -308,45 +444,57 @@ func (s *FullNodeServiceMetrics) SignagePoint(resp *types.WebsocketResponse) {
 	}
 
 	// total signage current
+	s.recordSignagePointTiming()
 	s.totalSignagePoints.Inc()
 	s.signagePointsSubSlot.Set(float64(64))
 	s.currentSignagePoint.Set(float64(signagePoint.BroadcastFarmer.SignagePointIndex))
 }
 
-// RefreshFileSizes periodically checks how large files related to the full node are
-func (s *FullNodeServiceMetrics) RefreshFileSizes() {
-	log.Info("cron: stai_full_node updating file sizes")
-	cfg, err := config.GetStaiConfig()
-	if err != nil {
-		log.Errorf("Error getting STAI config: %s\n", err.Error())
-	}
-	database := cfg.GetFullPath(cfg.FullNode.DatabasePath)
-	databaseWal := fmt.Sprintf("%s-wal", database)
-	databaseShm := fmt.Sprintf("%s-shm", database)
-	heightToHash := cfg.GetFullPath("db/height-to-hash")
-	peersDat := cfg.GetFullPath("db/peers.dat")
-	subEpochSummaries := cfg.GetFullPath("db/sub-epoch-summaries")
-
-	utils.LogErr(nil, nil, setGaugeToFilesize(database, s.database))
-	utils.LogErr(nil, nil, setGaugeToFilesize(databaseWal, s.databaseWal))
-	utils.LogErr(nil, nil, setGaugeToFilesize(databaseShm, s.databaseShm))
-	utils.LogErr(nil, nil, setGaugeToFilesize(heightToHash, s.heightToHash))
-	utils.LogErr(nil, nil, setGaugeToFilesize(peersDat, s.peersDat))
-	utils.LogErr(nil, nil, setGaugeToFilesize(subEpochSummaries, s.subEpochSummaries))
+// feeEstimateOptions are the options for get_fee_estimate on the full node
+type feeEstimateOptions struct {
+	Cost        uint64   `json:"cost"`
+	TargetTimes []uint64 `json:"target_times"`
 }
 
-func setGaugeToFilesize(file string, g *wrappedPrometheus.LazyGauge) error {
-	log.Debugf("file: stai_full_node Getting filesize of %s\n", file)
-	fi, err := os.Stat(file)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			log.Debugf("file: stai_full_node file doesn't exist: %s\n", file)
-			return nil
-		}
-		return err
+// feeEstimateResponse is the response from get_fee_estimate on the full node
+type feeEstimateResponse struct {
+	Success        bool      `json:"success"`
+	Error          string    `json:"error"`
+	Estimates      []float64 `json:"estimates"`
+	TargetTimes    []uint64  `json:"target_times"`
+	CurrentFeeRate float64   `json:"current_fee_rate"`
+}
+
+// RefreshFeeEstimates asks the full node for fee estimates for each of the configured costs and target times
+func (s *FullNodeServiceMetrics) RefreshFeeEstimates() {
+	var targetTimes []uint64
+	for _, target := range viper.GetIntSlice("fee-estimate-target-times") {
+		targetTimes = append(targetTimes, uint64(target))
 	}
 
-	g.Set(float64(fi.Size()))
+	for _, cost := range viper.GetIntSlice("fee-estimate-costs") {
+		estimate := &feeEstimateResponse{}
+		err := s.metrics.httpRequest(rpcinterface.ServiceFullNode, "get_fee_estimate", &feeEstimateOptions{Cost: uint64(cost), TargetTimes: targetTimes}, estimate)
+		if err != nil {
+			log.Debugf("Could not get fee estimate for cost %d from full node: %s\n", cost, err.Error())
+			continue
+		}
+		if !estimate.Success {
+			log.Debugf("Full node could not estimate fees for cost %d: %s\n", cost, estimate.Error)
+			continue
+		}
 
-	return nil
+		s.currentFeeRate.Set(estimate.CurrentFeeRate)
+		costLabel := fmt.Sprintf("%d", cost)
+		for i, fee := range estimate.Estimates {
+			if i >= len(estimate.TargetTimes) {
+				break
+			}
+			targetLabel := fmt.Sprintf("%d", estimate.TargetTimes[i])
+			s.feeEstimate.WithLabelValues(costLabel, targetLabel).Set(fee)
+			if cost > 0 {
+				s.feeRateEstimate.WithLabelValues(costLabel, targetLabel).Set(fee / float64(cost))
+			}
+		}
+	}
 }
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/forks-lab/go-stai-libs/pkg/rpcinterface"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Metrics about the contents of the full node's mempool are in this file
+
+// mempoolThrottleFactor is how many times longer than the last fetch of the mempool we wait before fetching again
+// Large mempools take a while for the full node to serialize, so this backs off when the mempool is busy
+const mempoolThrottleFactor = 10
+
+// Histogram buckets for the items in the mempool
+var (
+	mempoolFeePerCostBuckets = []float64{0, 0.5, 1, 2, 5, 10, 20, 50, 100, 500, 1000}
+	mempoolCostBuckets       = []float64{1e6, 5e6, 1e7, 2e7, 5e7, 1e8, 5e8, 1e9, 5e9, 1e10}
+	mempoolAgeBuckets        = []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+)
+
+// mempoolItemsResponse is the response from get_all_mempool_items on the full node
+type mempoolItemsResponse struct {
+	Success      bool                    `json:"success"`
+	MempoolItems map[string]*mempoolItem `json:"mempool_items"`
+}
+
+// mempoolItem is a single item in the mempool
+type mempoolItem struct {
+	Fee                  uint64 `json:"fee"`
+	Cost                 uint64 `json:"cost"`
+	HeightAddedToMempool uint32 `json:"height_added_to_mempool"`
+}
+
+// feeRate returns the fee per cost of the mempool item
+func (i *mempoolItem) feeRate() float64 {
+	if i.Cost == 0 {
+		return 0
+	}
+	return float64(i.Fee) / float64(i.Cost)
+}
+
+// mempoolFeeRatePercentiles are the percentiles of fee per cost exported for the items in the mempool
+var mempoolFeeRatePercentiles = []float64{10, 25, 50, 75, 90, 99}
+
+// initMempoolMetrics sets up the mempool content metrics
+func (s *FullNodeServiceMetrics) initMempoolMetrics() {
+	s.mempoolFeePerCost = s.metrics.newSnapshotHistogram(staiServiceFullNode, "mempool_item_fee_per_cost", "Distribution of fee per cost of the items currently in the mempool", mempoolFeePerCostBuckets)
+	s.mempoolItemCost = s.metrics.newSnapshotHistogram(staiServiceFullNode, "mempool_item_cost", "Distribution of the cost of the spend bundles currently in the mempool", mempoolCostBuckets)
+	s.mempoolItemAge = s.metrics.newSnapshotHistogram(staiServiceFullNode, "mempool_item_age_blocks", "Distribution of the number of blocks the items currently in the mempool have been waiting", mempoolAgeBuckets)
+	s.mempoolZeroFeeItems = s.metrics.newGauge(staiServiceFullNode, "mempool_zero_fee_items", "Number of items in the mempool that pay no fee")
+	s.mempoolTotalFees = s.metrics.newGauge(staiServiceFullNode, "mempool_total_fees", "Total fees of all items waiting in the mempool, in mojos")
+}
+
+// unregisterMempoolMetrics stops reporting mempool contents until we have new data
+func (s *FullNodeServiceMetrics) unregisterMempoolMetrics() {
+	s.mempoolFeePerCost.Unregister()
+	s.mempoolItemCost.Unregister()
+	s.mempoolItemAge.Unregister()
+	s.mempoolZeroFeeItems.Unregister()
+	s.mempoolTotalFees.Unregister()
+	s.mempoolFeeRatePercent.Reset()
+}
+
+// RefreshMempool asks the full node for all items in the mempool, unless the last fetch was too recent for how long
+// it took
+func (s *FullNodeServiceMetrics) RefreshMempool() {
+	if time.Now().Before(s.mempoolNextFetch) {
+		return
+	}
+
+	start := time.Now()
+	items := &mempoolItemsResponse{}
+	err := s.metrics.httpRequest(rpcinterface.ServiceFullNode, "get_all_mempool_items", nil, items)
+	took := time.Since(start)
+	s.mempoolNextFetch = start.Add(mempoolThrottleFactor * took)
+	if err != nil {
+		log.Debugf("Could not get mempool items from full node: %s\n", err.Error())
+		return
+	}
+	if took*mempoolThrottleFactor > viper.GetDuration("mempool-refresh-interval") {
+		log.Debugf("Fetching the mempool took %s, waiting %s before fetching again\n", took, took*mempoolThrottleFactor)
+	}
+
+	s.ProcessMempoolFeeRates(items)
+	s.ProcessMempoolItems(items)
+}
+
+// ProcessMempoolFeeRates calculates fee per cost percentiles for the items in the mempool
+func (s *FullNodeServiceMetrics) ProcessMempoolFeeRates(items *mempoolItemsResponse) {
+	var feeRates []float64
+	for _, item := range items.MempoolItems {
+		if item == nil {
+			continue
+		}
+		feeRates = append(feeRates, item.feeRate())
+	}
+
+	if len(feeRates) == 0 {
+		s.mempoolFeeRatePercent.Reset()
+		return
+	}
+
+	sort.Float64s(feeRates)
+	for _, percentile := range mempoolFeeRatePercentiles {
+		index := int(percentile / 100 * float64(len(feeRates)-1))
+		s.mempoolFeeRatePercent.WithLabelValues(fmt.Sprintf("%g", percentile)).Set(feeRates[index])
+	}
+}
+
+// ProcessMempoolItems exports the distribution of fees, costs, and ages of the items in the mempool
+func (s *FullNodeServiceMetrics) ProcessMempoolItems(items *mempoolItemsResponse) {
+	peakHeight := atomic.LoadUint32(&s.peakHeight)
+
+	var feeRates, costs, ages []float64
+	zeroFee := 0
+	totalFees := uint64(0)
+	for _, item := range items.MempoolItems {
+		if item == nil {
+			continue
+		}
+
+		feeRates = append(feeRates, item.feeRate())
+		costs = append(costs, float64(item.Cost))
+		if peakHeight > 0 && item.HeightAddedToMempool > 0 && peakHeight >= item.HeightAddedToMempool {
+			ages = append(ages, float64(peakHeight-item.HeightAddedToMempool))
+		}
+		if item.Fee == 0 {
+			zeroFee++
+		}
+		totalFees += item.Fee
+	}
+
+	s.mempoolFeePerCost.Set(feeRates)
+	s.mempoolItemCost.Set(costs)
+	s.mempoolItemAge.Set(ages)
+	s.mempoolZeroFeeItems.Set(float64(zeroFee))
+	s.mempoolTotalFees.Set(float64(totalFees))
+}
@@ -0,0 +1,218 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/forks-lab/go-stai-libs/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Metrics about the individual full node peers of the full node are in this file
+
+// Values for the full-node-peer-metrics flag
+const (
+	peerMetricsOff    = "off"
+	peerMetricsIP     = "ip"
+	peerMetricsSubnet = "subnet"
+
+	// peerMetricsVersion is not supported, since get_connections doesn't include the version of each peer
+	peerMetricsVersion = "version"
+)
+
+// peerGroupOther is the label used for all peers beyond the cardinality cap
+const peerGroupOther = "other"
+
+// peerConnectionsResponse is the response from get_connections, including the fields types.Connection doesn't parse
+type peerConnectionsResponse struct {
+	Success     bool              `json:"success"`
+	Connections []*peerConnection `json:"connections"`
+}
+
+// peerConnection is a single connection from get_connections
+type peerConnection struct {
+	types.Connection
+	CreationTime    float64 `json:"creation_time"`
+	LastMessageTime float64 `json:"last_message_time"`
+}
+
+// peerGroup holds the combined data for all peers that share a label
+type peerGroup struct {
+	label              string
+	peers              int
+	bytesRead          uint64
+	bytesWritten       uint64
+	peakHeight         uint32
+	connectedSeconds   float64
+	lastMessageSeconds float64
+}
+
+// add combines a peer into the group
+func (g *peerGroup) add(peers int, bytesRead, bytesWritten uint64, peakHeight uint32, connectedSeconds, lastMessageSeconds float64) {
+	g.peers += peers
+	g.bytesRead += bytesRead
+	g.bytesWritten += bytesWritten
+	if peakHeight > g.peakHeight {
+		g.peakHeight = peakHeight
+	}
+	if connectedSeconds > g.connectedSeconds {
+		g.connectedSeconds = connectedSeconds
+	}
+	if lastMessageSeconds > g.lastMessageSeconds {
+		g.lastMessageSeconds = lastMessageSeconds
+	}
+}
+
+// initPeerMetrics sets up the per peer metrics
+func (s *FullNodeServiceMetrics) initPeerMetrics() {
+	switch viper.GetString("full-node-peer-metrics") {
+	case peerMetricsOff, peerMetricsIP, peerMetricsSubnet:
+	case peerMetricsVersion:
+		log.Errorln("full-node-peer-metrics mode version is not supported, since the full node doesn't report the version of each peer. Per peer metrics are disabled")
+	default:
+		log.Errorf("Invalid full-node-peer-metrics mode %s. Per peer metrics are disabled\n", viper.GetString("full-node-peer-metrics"))
+	}
+
+	peerLabels := []string{"peer"}
+	s.peerCount = s.metrics.newGaugeVec(staiServiceFullNode, "peer_count", "Number of connected full node peers in the group", peerLabels)
+	s.peerBytesRead = s.metrics.newGaugeVec(staiServiceFullNode, "peer_bytes_read", "Bytes read from the full node peers in the group, since they connected", peerLabels)
+	s.peerBytesWritten = s.metrics.newGaugeVec(staiServiceFullNode, "peer_bytes_written", "Bytes written to the full node peers in the group, since they connected", peerLabels)
+	s.peerPeakHeight = s.metrics.newGaugeVec(staiServiceFullNode, "peer_peak_height", "Highest peak height reported by the full node peers in the group", peerLabels)
+	s.peerConnectedSeconds = s.metrics.newGaugeVec(staiServiceFullNode, "peer_connected_seconds", "Time the longest connected full node peer in the group has been connected, in seconds", peerLabels)
+	s.peerLastMessageSeconds = s.metrics.newGaugeVec(staiServiceFullNode, "peer_last_message_seconds", "Time since the last message from the least recently active full node peer in the group, in seconds", peerLabels)
+}
+
+// resetPeerMetrics clears all per peer metrics
+func (s *FullNodeServiceMetrics) resetPeerMetrics() {
+	s.peerCount.Reset()
+	s.peerBytesRead.Reset()
+	s.peerBytesWritten.Reset()
+	s.peerPeakHeight.Reset()
+	s.peerConnectedSeconds.Reset()
+	s.peerLastMessageSeconds.Reset()
+	s.peerGroups = map[string]bool{}
+}
+
+// GetPeerConnections exports metrics for the full node peers from a get_connections response, if enabled
+func (s *FullNodeServiceMetrics) GetPeerConnections(resp *types.WebsocketResponse) {
+	mode := viper.GetString("full-node-peer-metrics")
+	switch mode {
+	case peerMetricsIP, peerMetricsSubnet:
+	default:
+		return
+	}
+
+	connections := &peerConnectionsResponse{}
+	err := json.Unmarshal(resp.Data, connections)
+	if err != nil {
+		log.Errorf("Error unmarshalling: %s\n", err.Error())
+		return
+	}
+
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	groups := map[string]*peerGroup{}
+	for _, connection := range connections.Connections {
+		if connection == nil || connection.Type != types.NodeTypeFullNode {
+			continue
+		}
+
+		label := peerGroupLabel(mode, connection)
+		group, ok := groups[label]
+		if !ok {
+			group = &peerGroup{label: label}
+			groups[label] = group
+		}
+		group.add(1, connection.BytesRead, connection.BytesWritten, connection.PeakHeight, secondsSince(now, connection.CreationTime), secondsSince(now, connection.LastMessageTime))
+	}
+
+	s.ProcessPeerGroups(capPeerGroups(groups, viper.GetInt("full-node-peer-metrics-limit")))
+}
+
+// ProcessPeerGroups updates the per peer metrics with the provided groups, and removes groups that are no longer
+// included, so disconnected peers stop reporting
+func (s *FullNodeServiceMetrics) ProcessPeerGroups(groups []*peerGroup) {
+	included := map[string]bool{}
+	for _, group := range groups {
+		included[group.label] = true
+	}
+	for label := range s.peerGroups {
+		if !included[label] {
+			s.peerCount.DeleteLabelValues(label)
+			s.peerBytesRead.DeleteLabelValues(label)
+			s.peerBytesWritten.DeleteLabelValues(label)
+			s.peerPeakHeight.DeleteLabelValues(label)
+			s.peerConnectedSeconds.DeleteLabelValues(label)
+			s.peerLastMessageSeconds.DeleteLabelValues(label)
+		}
+	}
+	s.peerGroups = included
+
+	for _, group := range groups {
+		s.peerCount.WithLabelValues(group.label).Set(float64(group.peers))
+		s.peerBytesRead.WithLabelValues(group.label).Set(float64(group.bytesRead))
+		s.peerBytesWritten.WithLabelValues(group.label).Set(float64(group.bytesWritten))
+		s.peerPeakHeight.WithLabelValues(group.label).Set(float64(group.peakHeight))
+		s.peerConnectedSeconds.WithLabelValues(group.label).Set(group.connectedSeconds)
+		s.peerLastMessageSeconds.WithLabelValues(group.label).Set(group.lastMessageSeconds)
+	}
+}
+
+// peerGroupLabel returns the label a connection is reported under for the given mode
+func peerGroupLabel(mode string, connection *peerConnection) string {
+	switch mode {
+	case peerMetricsSubnet:
+		if ip4 := connection.PeerHost.To4(); ip4 != nil {
+			return fmt.Sprintf("%s/24", ip4.Mask(net.CIDRMask(24, 32)).String())
+		}
+		if connection.PeerHost.IP != nil {
+			return fmt.Sprintf("%s/48", connection.PeerHost.Mask(net.CIDRMask(48, 128)).String())
+		}
+		return "unknown"
+	default:
+		return net.JoinHostPort(connection.PeerHost.String(), strconv.Itoa(int(connection.PeerPort)))
+	}
+}
+
+// capPeerGroups limits the number of groups to limit, combining the smallest groups into a single "other" group
+// Larger and longer connected groups are kept, so labels stay stable between updates
+func capPeerGroups(groups map[string]*peerGroup, limit int) []*peerGroup {
+	var sorted []*peerGroup
+	for _, group := range groups {
+		sorted = append(sorted, group)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].peers != sorted[j].peers {
+			return sorted[i].peers > sorted[j].peers
+		}
+		if sorted[i].connectedSeconds != sorted[j].connectedSeconds {
+			return sorted[i].connectedSeconds > sorted[j].connectedSeconds
+		}
+		return sorted[i].label < sorted[j].label
+	})
+
+	if limit <= 0 || len(sorted) <= limit {
+		return sorted
+	}
+
+	// Leave room for the "other" group within the limit
+	keep := limit - 1
+	other := &peerGroup{label: peerGroupOther}
+	for _, group := range sorted[keep:] {
+		other.add(group.peers, group.bytesRead, group.bytesWritten, group.peakHeight, group.connectedSeconds, group.lastMessageSeconds)
+	}
+
+	return append(sorted[:keep], other)
+}
+
+// secondsSince returns the seconds between a unix timestamp and now, or 0 if the timestamp is missing
+func secondsSince(now float64, timestamp float64) float64 {
+	if timestamp <= 0 || timestamp > now {
+		return 0
+	}
+	return now - timestamp
+}
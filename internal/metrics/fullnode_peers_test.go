@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestCapPeerGroups(t *testing.T) {
+	groups := func() map[string]*peerGroup {
+		return map[string]*peerGroup{
+			"a": {label: "a", peers: 5, bytesRead: 10},
+			"b": {label: "b", peers: 3, bytesRead: 20, connectedSeconds: 100},
+			"c": {label: "c", peers: 3, bytesRead: 30, connectedSeconds: 50},
+			"d": {label: "d", peers: 1, bytesRead: 40},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		limit      int
+		wantLabels []string
+		wantPeers  []int
+		wantRead   []uint64
+	}{
+		{
+			name:       "no limit",
+			limit:      0,
+			wantLabels: []string{"a", "b", "c", "d"},
+			wantPeers:  []int{5, 3, 3, 1},
+			wantRead:   []uint64{10, 20, 30, 40},
+		},
+		{
+			name:       "under the limit",
+			limit:      4,
+			wantLabels: []string{"a", "b", "c", "d"},
+			wantPeers:  []int{5, 3, 3, 1},
+			wantRead:   []uint64{10, 20, 30, 40},
+		},
+		{
+			name:       "over the limit",
+			limit:      3,
+			wantLabels: []string{"a", "b", peerGroupOther},
+			wantPeers:  []int{5, 3, 4},
+			wantRead:   []uint64{10, 20, 70},
+		},
+		{
+			name:       "limit of one",
+			limit:      1,
+			wantLabels: []string{peerGroupOther},
+			wantPeers:  []int{12},
+			wantRead:   []uint64{100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capped := capPeerGroups(groups(), tt.limit)
+			if len(capped) != len(tt.wantLabels) {
+				t.Fatalf("got %d groups, want %d", len(capped), len(tt.wantLabels))
+			}
+			for i, group := range capped {
+				if group.label != tt.wantLabels[i] || group.peers != tt.wantPeers[i] || group.bytesRead != tt.wantRead[i] {
+					t.Errorf("group %d = %s with %d peers and %d bytes read, want %s with %d peers and %d bytes read", i, group.label, group.peers, group.bytesRead, tt.wantLabels[i], tt.wantPeers[i], tt.wantRead[i])
+				}
+			}
+		})
+	}
+}
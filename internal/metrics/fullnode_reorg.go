@@ -0,0 +1,226 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/forks-lab/go-stai-libs/pkg/rpc"
+	"github.com/forks-lab/go-stai-libs/pkg/rpcinterface"
+	log "github.com/sirupsen/logrus"
+)
+
+// Chain reorganization detection for the full node is in this file
+
+// reorgTrackingDepth is the number of recent peaks kept to detect reorgs. Reorgs deeper than this are still detected,
+// but the depth is reported as this value
+const reorgTrackingDepth = 256
+
+// reorgDepthBuckets are the histogram buckets for the depth of reorgs, in blocks
+var reorgDepthBuckets = []float64{1, 2, 3, 4, 5, 6, 8, 10, 16, 32, 64, 128, 256}
+
+// peakTracker remembers the header hashes of recent peaks, to detect when the peak moves to a different chain
+// Peaks are only tracked while the node is synced, since the peak jumps around while syncing
+type peakTracker struct {
+	lock       sync.Mutex
+	synced     bool
+	hashes     map[uint32]string
+	peakHeight uint32
+	peakHash   string
+}
+
+// setSynced updates the sync state of the node. Tracked peaks are forgotten when the node is not synced
+func (t *peakTracker) setSynced(synced bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.synced = synced
+	if !synced || t.hashes == nil {
+		t.hashes = map[uint32]string{}
+		t.peakHeight = 0
+		t.peakHash = ""
+	}
+}
+
+// reorg describes a chain reorganization found by the peak tracker
+type reorg struct {
+	oldHeight uint32
+	oldHash   string
+	depth     uint32
+}
+
+// blockHashLookup returns the header hash of the block at a height on the node's current chain
+type blockHashLookup func(height uint32) (string, error)
+
+// TrackPeak records a new peak from a block event or blockchain state, and records a reorg if the new peak conflicts
+// with a block already seen at the same height, or if the previous peak is no longer part of the chain. prevHash is
+// optional, since block events don't include it
+func (s *FullNodeServiceMetrics) TrackPeak(height uint32, headerHash string, prevHash string) {
+	r := s.peaks.track(height, headerHash, prevHash, s.blockHashAtHeight)
+	if r == nil {
+		return
+	}
+
+	log.Warnf("Chain reorganization detected. Old peak %d %s, new peak %d %s, depth %d\n", r.oldHeight, r.oldHash, height, headerHash, r.depth)
+	s.reorgs.Inc()
+	s.reorgDepth.Observe(float64(r.depth))
+}
+
+// blockHashAtHeight asks the full node for the header hash of the block at a height
+func (s *FullNodeServiceMetrics) blockHashAtHeight(height uint32) (string, error) {
+	record := &rpc.GetBlockRecordResponse{}
+	err := s.metrics.httpRequest(rpcinterface.ServiceFullNode, "get_block_record_by_height", &rpc.GetBlockByHeightOptions{BlockHeight: int(height)}, record)
+	if err != nil {
+		return "", err
+	}
+	if !record.Success || record.BlockRecord == nil {
+		return "", fmt.Errorf("no block record at height %d", height)
+	}
+	return record.BlockRecord.HeaderHash, nil
+}
+
+// track records a new peak, and returns the reorg if the new peak is on a different chain than the tracked peaks
+// The node is asked for blocks with lookup without holding the lock, so other peaks can be recorded meanwhile
+func (t *peakTracker) track(height uint32, headerHash string, prevHash string, lookup blockHashLookup) *reorg {
+	if headerHash == "" {
+		return nil
+	}
+
+	t.lock.Lock()
+	if !t.synced {
+		t.lock.Unlock()
+		return nil
+	}
+
+	// Blockchain state updates and block events report the same peaks, sometimes out of order, so a different block at
+	// a height that was already seen is a reorg. Block events don't include the parent, so when the peak jumps ahead by
+	// more than one block, the node is asked whether the previous peak is still part of the chain
+	conflict := t.conflicts(height, headerHash, prevHash)
+	jumped := !conflict && t.peakHash != "" && height > t.peakHeight+1
+	if !conflict && !jumped {
+		t.record(height, headerHash, prevHash, false)
+		t.lock.Unlock()
+		return nil
+	}
+
+	hashes := make(map[uint32]string, len(t.hashes))
+	for h, hash := range t.hashes {
+		hashes[h] = hash
+	}
+	oldHeight := t.peakHeight
+	oldHash := t.peakHash
+	t.lock.Unlock()
+
+	if jumped {
+		hash, err := lookup(oldHeight)
+		if err != nil || hash == oldHash {
+			if err != nil {
+				log.Debugf("Could not get block record to check for a reorg: %s\n", err.Error())
+			}
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			if t.synced {
+				t.record(height, headerHash, prevHash, false)
+			}
+			return nil
+		}
+	}
+
+	fork := findForkHeight(hashes, oldHeight, height, prevHash, lookup)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.synced {
+		return nil
+	}
+	if !t.conflicts(height, headerHash, prevHash) && t.peakHash != oldHash {
+		// Another update already recorded this reorg
+		t.record(height, headerHash, prevHash, false)
+		return nil
+	}
+
+	depth := uint32(1)
+	if oldHeight > fork {
+		depth = oldHeight - fork
+	}
+
+	// Anything above the fork point is no longer part of the chain
+	for h := range t.hashes {
+		if h > fork {
+			delete(t.hashes, h)
+		}
+	}
+	t.record(height, headerHash, prevHash, true)
+
+	return &reorg{oldHeight: oldHeight, oldHash: oldHash, depth: depth}
+}
+
+// conflicts returns true if a different block was already seen at the height of the peak, or of its parent
+// Must be called with the lock held
+func (t *peakTracker) conflicts(height uint32, headerHash string, prevHash string) bool {
+	if known, ok := t.hashes[height]; ok && known != headerHash {
+		return true
+	}
+	if prevHash != "" && height > 0 {
+		if known, ok := t.hashes[height-1]; ok && known != prevHash {
+			return true
+		}
+	}
+	return false
+}
+
+// record remembers the hashes of a peak and its parent. The peak only moves to a lower height after a reorg, so peaks
+// reported out of order don't move it back. Must be called with the lock held
+func (t *peakTracker) record(height uint32, headerHash string, prevHash string, reorg bool) {
+	t.hashes[height] = headerHash
+	if prevHash != "" && height > 0 {
+		t.hashes[height-1] = prevHash
+	}
+	if reorg || height >= t.peakHeight {
+		t.peakHeight = height
+		t.peakHash = headerHash
+	}
+
+	for h := range t.hashes {
+		if h+reorgTrackingDepth < t.peakHeight {
+			delete(t.hashes, h)
+		}
+	}
+}
+
+// findForkHeight returns the height of the highest block shared by the tracked chain and the chain of the new peak
+// hashes and peakHeight are a copy of the tracked chain, so this is called without the peak tracker lock held.
+// Only the parent of the new peak may be known, so the node is asked for the rest of the new chain with lookup as
+// needed. If the node can't be asked, the highest block that could be compared is assumed to be the fork point
+func findForkHeight(hashes map[uint32]string, peakHeight uint32, height uint32, prevHash string, lookup blockHashLookup) uint32 {
+	if height == 0 {
+		return 0
+	}
+
+	start := height - 1
+	if start > peakHeight {
+		start = peakHeight
+	}
+	for h := start; ; h-- {
+		known, ok := hashes[h]
+		if !ok || h == 0 || h+reorgTrackingDepth < peakHeight {
+			// We have nothing older to compare against
+			return h
+		}
+
+		newHash := ""
+		if h == height-1 && prevHash != "" {
+			newHash = prevHash
+		} else {
+			var err error
+			newHash, err = lookup(h)
+			if err != nil {
+				log.Debugf("Could not get block record to find reorg depth: %s\n", err.Error())
+				return start
+			}
+		}
+
+		if newHash == known {
+			return h
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testPeak is a peak reported to the tracker in tests
+type testPeak struct {
+	height     uint32
+	headerHash string
+	prevHash   string
+}
+
+func TestPeakTrackerTrack(t *testing.T) {
+	tests := []struct {
+		name string
+		// chain is the node's current chain, by height, used to look up blocks
+		chain      map[uint32]string
+		peaks      []testPeak
+		wantDepths []uint32
+		wantPeak   uint32
+	}{
+		{
+			name: "in order peaks",
+			peaks: []testPeak{
+				{10, "a10", "a9"},
+				{11, "a11", ""},
+				{12, "a12", "a11"},
+			},
+			wantPeak: 12,
+		},
+		{
+			name: "out of order duplicates",
+			peaks: []testPeak{
+				{10, "a10", "a9"},
+				{11, "a11", ""},
+				{12, "a12", "a11"},
+				{11, "a11", ""},
+				{10, "a10", ""},
+				{12, "a12", "a11"},
+			},
+			wantPeak: 12,
+		},
+		{
+			name:  "one block reorg",
+			chain: map[uint32]string{10: "a10", 11: "b11"},
+			peaks: []testPeak{
+				{10, "a10", "a9"},
+				{11, "a11", "a10"},
+				{11, "b11", "a10"},
+				{11, "b11", ""},
+			},
+			wantDepths: []uint32{1},
+			wantPeak:   11,
+		},
+		{
+			name:  "reorg to a chain that jumps ahead",
+			chain: map[uint32]string{10: "a10", 11: "b11", 12: "b12", 13: "b13"},
+			peaks: []testPeak{
+				{10, "a10", "a9"},
+				{11, "a11", "a10"},
+				{12, "a12", "a11"},
+				{14, "b14", ""},
+			},
+			wantDepths: []uint32{2},
+			wantPeak:   14,
+		},
+		{
+			name:  "jump ahead on the same chain",
+			chain: map[uint32]string{10: "a10", 11: "a11", 12: "a12"},
+			peaks: []testPeak{
+				{10, "a10", "a9"},
+				{11, "a11", "a10"},
+				{14, "a14", ""},
+			},
+			wantPeak: 14,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookup := func(height uint32) (string, error) {
+				hash, ok := tt.chain[height]
+				if !ok {
+					return "", fmt.Errorf("no block at height %d", height)
+				}
+				return hash, nil
+			}
+
+			tracker := &peakTracker{}
+			tracker.setSynced(true)
+
+			var depths []uint32
+			for _, peak := range tt.peaks {
+				if r := tracker.track(peak.height, peak.headerHash, peak.prevHash, lookup); r != nil {
+					depths = append(depths, r.depth)
+				}
+			}
+
+			if !reflect.DeepEqual(depths, tt.wantDepths) {
+				t.Errorf("reorg depths = %v, want %v", depths, tt.wantDepths)
+			}
+			if tracker.peakHeight != tt.wantPeak {
+				t.Errorf("peak height = %d, want %d", tracker.peakHeight, tt.wantPeak)
+			}
+		})
+	}
+}
+
+func TestPeakTrackerNotSynced(t *testing.T) {
+	tracker := &peakTracker{}
+	tracker.setSynced(false)
+
+	tracker.track(10, "a10", "a9", nil)
+	if r := tracker.track(10, "b10", "a9", nil); r != nil {
+		t.Errorf("reorg recorded while not synced")
+	}
+	if tracker.peakHeight != 0 {
+		t.Errorf("peak height = %d, want 0", tracker.peakHeight)
+	}
+}
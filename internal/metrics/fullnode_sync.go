@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/forks-lab/go-stai-libs/pkg/types"
+)
+
+// Sync progress metrics for the full node are in this file
+
+// syncRateWindow is how far back sync progress is remembered to calculate the recent sync rate
+const syncRateWindow = 10 * time.Minute
+
+// syncSample is the sync progress height at a point in time
+type syncSample struct {
+	time   time.Time
+	height uint32
+}
+
+// syncTracker remembers recent sync progress to calculate the sync rate
+type syncTracker struct {
+	lock    sync.Mutex
+	samples []syncSample
+}
+
+// add records the current progress height and returns the sync rate over the window, in blocks per second
+// Returns 0 if there isn't enough data to calculate a rate
+func (t *syncTracker) add(now time.Time, height uint32) float64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Progress went backwards, so the node started syncing again or switched to another chain
+	if len(t.samples) > 0 && height < t.samples[len(t.samples)-1].height {
+		t.samples = nil
+	}
+
+	t.samples = append(t.samples, syncSample{time: now, height: height})
+	for len(t.samples) > 1 && now.Sub(t.samples[0].time) > syncRateWindow {
+		t.samples = t.samples[1:]
+	}
+
+	oldest := t.samples[0]
+	elapsed := now.Sub(oldest.time).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(height-oldest.height) / elapsed
+}
+
+// reset forgets all sync progress
+func (t *syncTracker) reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.samples = nil
+}
+
+// initSyncMetrics sets up the sync progress metrics
+func (s *FullNodeServiceMetrics) initSyncMetrics() {
+	s.syncTipHeight = s.metrics.newGauge(staiServiceFullNode, "sync_tip_height", "Height of the chain the node is syncing to")
+	s.syncProgressHeight = s.metrics.newGauge(staiServiceFullNode, "sync_progress_height", "Height the node has synced up to")
+	s.blocksBehind = s.metrics.newGauge(staiServiceFullNode, "blocks_behind", "Number of blocks the node needs to sync to catch up to the sync tip. 0 when synced")
+	s.syncRate = s.metrics.newGauge(staiServiceFullNode, "sync_rate", "Recent sync rate, in blocks per second")
+	s.syncTimeRemaining = s.metrics.newGauge(staiServiceFullNode, "sync_time_remaining_seconds", "Estimated time until the node is synced, in seconds, based on the recent sync rate")
+}
+
+// unregisterSyncMetrics stops reporting sync progress until we have new data
+func (s *FullNodeServiceMetrics) unregisterSyncMetrics() {
+	s.syncTipHeight.Unregister()
+	s.syncProgressHeight.Unregister()
+	s.blocksBehind.Unregister()
+	s.syncRate.Unregister()
+	s.syncTimeRemaining.Unregister()
+	s.syncProgress.reset()
+}
+
+// ProcessSyncState updates sync progress metrics from the sync section of the blockchain state
+func (s *FullNodeServiceMetrics) ProcessSyncState(syncState *types.Sync, peak *types.BlockRecord) {
+	if syncState == nil {
+		return
+	}
+
+	if syncState.Synced {
+		s.syncProgress.reset()
+		if peak != nil {
+			s.syncTipHeight.Set(float64(peak.Height))
+			s.syncProgressHeight.Set(float64(peak.Height))
+		}
+		s.blocksBehind.Set(0)
+		s.syncRate.Unregister()
+		s.syncTimeRemaining.Set(0)
+		return
+	}
+
+	if !syncState.SyncMode {
+		// Not synced, but not syncing either, such as while waiting for peers. Nothing meaningful to report
+		s.unregisterSyncMetrics()
+		return
+	}
+
+	tip := syncState.SyncTipHeight
+	progress := syncState.SyncProgressHeight
+	behind := uint32(0)
+	if tip > progress {
+		behind = tip - progress
+	}
+
+	s.syncTipHeight.Set(float64(tip))
+	s.syncProgressHeight.Set(float64(progress))
+	s.blocksBehind.Set(float64(behind))
+
+	rate := s.syncProgress.add(time.Now(), progress)
+	if rate <= 0 {
+		s.syncRate.Unregister()
+		s.syncTimeRemaining.Unregister()
+		return
+	}
+	s.syncRate.Set(rate)
+	s.syncTimeRemaining.Set(float64(behind) / rate)
+}
@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"github.com/forks-lab/go-stai-libs/pkg/rpc"
+	"github.com/forks-lab/go-stai-libs/pkg/rpcinterface"
+	"github.com/forks-lab/go-stai-libs/pkg/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Transaction throughput metrics for each transaction block are in this file
+
+// transactionBlockQueueSize is the number of transaction blocks that can wait to be fetched. When the queue is full,
+// new blocks are skipped rather than delaying the websocket handler
+const transactionBlockQueueSize = 16
+
+// Histogram buckets for transaction block throughput
+var (
+	transactionsPerSecondBuckets = []float64{0, 0.1, 0.25, 0.5, 1, 2, 5, 10, 20, 50, 100}
+	spendsPerBlockBuckets        = []float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+)
+
+// coinRecord is a coin record returned by the full node
+type coinRecord struct {
+	Coin                types.Coin `json:"coin"`
+	ConfirmedBlockIndex uint32     `json:"confirmed_block_index"`
+	SpentBlockIndex     uint32     `json:"spent_block_index"`
+	Spent               bool       `json:"spent"`
+	Coinbase            bool       `json:"coinbase"`
+	Timestamp           uint64     `json:"timestamp"`
+}
+
+// additionsAndRemovalsOptions are the options for get_additions_and_removals on the full node
+type additionsAndRemovalsOptions struct {
+	HeaderHash string `json:"header_hash"`
+}
+
+// additionsAndRemovalsResponse is the response from get_additions_and_removals on the full node
+type additionsAndRemovalsResponse struct {
+	Success   bool          `json:"success"`
+	Error     string        `json:"error"`
+	Additions []*coinRecord `json:"additions"`
+	Removals  []*coinRecord `json:"removals"`
+}
+
+// blockRecordOptions are the options for get_block_record on the full node
+type blockRecordOptions struct {
+	HeaderHash string `json:"header_hash"`
+}
+
+// initThroughputMetrics sets up the transaction block throughput metrics
+func (s *FullNodeServiceMetrics) initThroughputMetrics() {
+	s.transactionBlocks = make(chan string, transactionBlockQueueSize)
+
+	s.blockCoinsCreated = s.metrics.newGauge(staiServiceFullNode, "block_coins_created", "Number of coins created in the last transaction block")
+	s.blockCoinsSpent = s.metrics.newGauge(staiServiceFullNode, "block_coins_spent", "Number of coins spent in the last transaction block")
+	s.blockAmountMoved = s.metrics.newGauge(staiServiceFullNode, "block_amount_moved", "Total amount of the coins spent in the last transaction block, in mojos")
+	s.transactionsPerSecond = s.metrics.newHistogram(staiServiceFullNode, "transactions_per_second", "Coins spent per second in each transaction block, based on the time since the previous transaction block", transactionsPerSecondBuckets)
+	s.spendsPerBlock = s.metrics.newHistogram(staiServiceFullNode, "spends_per_block", "Number of coins spent in each transaction block", spendsPerBlockBuckets)
+}
+
+// unregisterThroughputMetrics stops reporting the last transaction block until we have new data
+func (s *FullNodeServiceMetrics) unregisterThroughputMetrics() {
+	s.blockCoinsCreated.Unregister()
+	s.blockCoinsSpent.Unregister()
+	s.blockAmountMoved.Unregister()
+}
+
+// queueTransactionBlock queues a transaction block to have its additions and removals fetched in the background
+func (s *FullNodeServiceMetrics) queueTransactionBlock(headerHash string) {
+	select {
+	case s.transactionBlocks <- headerHash:
+	default:
+		log.Debugf("Too many transaction blocks waiting to be fetched, skipping %s\n", headerHash)
+	}
+}
+
+// processTransactionBlocks fetches the additions and removals for queued transaction blocks, for the lifetime of
+// the process
+func (s *FullNodeServiceMetrics) processTransactionBlocks() {
+	// The previous transaction block we processed, to calculate the time between transaction blocks
+	var lastHeight uint32
+	var lastTimestamp uint64
+
+	for headerHash := range s.transactionBlocks {
+		record := &rpc.GetBlockRecordResponse{}
+		err := s.metrics.httpRequest(rpcinterface.ServiceFullNode, "get_block_record", &blockRecordOptions{HeaderHash: headerHash}, record)
+		if err != nil || !record.Success || record.BlockRecord == nil {
+			if err != nil {
+				log.Debugf("Could not get block record for %s: %s\n", headerHash, err.Error())
+			}
+			continue
+		}
+
+		coins := &additionsAndRemovalsResponse{}
+		err = s.metrics.httpRequest(rpcinterface.ServiceFullNode, "get_additions_and_removals", &additionsAndRemovalsOptions{HeaderHash: headerHash}, coins)
+		if err != nil {
+			log.Debugf("Could not get additions and removals for %s: %s\n", headerHash, err.Error())
+			continue
+		}
+		if !coins.Success {
+			log.Debugf("Full node could not get additions and removals for %s: %s\n", headerHash, coins.Error)
+			continue
+		}
+
+		amountMoved := 0.0
+		for _, removal := range coins.Removals {
+			if removal != nil {
+				amountMoved += float64(removal.Coin.Amount.Uint64())
+			}
+		}
+
+		spends := float64(len(coins.Removals))
+		s.blockCoinsCreated.Set(float64(len(coins.Additions)))
+		s.blockCoinsSpent.Set(spends)
+		s.blockAmountMoved.Set(amountMoved)
+		s.spendsPerBlock.Observe(spends)
+
+		// Only calculate a rate when we know the previous transaction block, since blocks can be skipped
+		block := record.BlockRecord
+		if lastTimestamp > 0 && block.PrevTransactionBlockHeight == lastHeight && block.Timestamp > lastTimestamp {
+			s.transactionsPerSecond.Observe(spends / float64(block.Timestamp-lastTimestamp))
+		}
+		lastHeight = block.Height
+		lastTimestamp = block.Timestamp
+	}
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Timing of block and signage point events seen by the full node is in this file
+
+// Histogram buckets, in seconds. Blocks target 18.75s, transaction blocks about 52s, and signage points 9.375s
+var (
+	blockIntervalBuckets            = []float64{1, 2, 5, 10, 15, 20, 30, 45, 60, 90, 120, 180, 300}
+	transactionBlockIntervalBuckets = []float64{5, 10, 20, 30, 45, 60, 90, 120, 180, 300, 600}
+	signagePointIntervalBuckets     = []float64{1, 2, 4, 6, 8, 9, 10, 12, 15, 20, 30, 60}
+)
+
+// eventTimer tracks when the last block, transaction block, and signage point events were received
+type eventTimer struct {
+	lock             sync.Mutex
+	lastBlock        time.Time
+	lastTxBlock      time.Time
+	lastSignagePoint time.Time
+
+	// The time since last transaction block gauge is computed when scraped, and only registered once we have seen one
+	sinceTxBlock           prometheus.GaugeFunc
+	sinceTxBlockRegistered bool
+}
+
+// initTimingMetrics sets up the block and signage point timing metrics
+func (s *FullNodeServiceMetrics) initTimingMetrics() {
+	s.blockInterval = s.metrics.newHistogram(staiServiceFullNode, "block_interval_seconds", "Time between consecutive block events, in seconds", blockIntervalBuckets)
+	s.transactionBlockInterval = s.metrics.newHistogram(staiServiceFullNode, "transaction_block_interval_seconds", "Time between consecutive transaction block events, in seconds", transactionBlockIntervalBuckets)
+	s.signagePointInterval = s.metrics.newHistogram(staiServiceFullNode, "signage_point_interval_seconds", "Time between consecutive signage point events, in seconds", signagePointIntervalBuckets)
+
+	s.timer.sinceTxBlock = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "stai",
+		Subsystem: string(staiServiceFullNode),
+		Name:      "seconds_since_last_transaction_block",
+		Help:      "Time since the last transaction block event was received, in seconds",
+	}, s.secondsSinceTransactionBlock)
+}
+
+// secondsSinceTransactionBlock returns the time since the last transaction block, for the gauge func
+func (s *FullNodeServiceMetrics) secondsSinceTransactionBlock() float64 {
+	s.timer.lock.Lock()
+	defer s.timer.lock.Unlock()
+
+	if s.timer.lastTxBlock.IsZero() {
+		return 0
+	}
+	return time.Since(s.timer.lastTxBlock).Seconds()
+}
+
+// recordBlockTiming records the interval since the previous block and, for transaction blocks, the previous
+// transaction block
+func (s *FullNodeServiceMetrics) recordBlockTiming(transactionBlock bool) {
+	t := &s.timer
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	if !t.lastBlock.IsZero() {
+		s.blockInterval.Observe(now.Sub(t.lastBlock).Seconds())
+	}
+	t.lastBlock = now
+
+	if !transactionBlock {
+		return
+	}
+	if !t.lastTxBlock.IsZero() {
+		s.transactionBlockInterval.Observe(now.Sub(t.lastTxBlock).Seconds())
+	}
+	t.lastTxBlock = now
+
+	if !t.sinceTxBlockRegistered {
+		t.sinceTxBlockRegistered = true
+		s.metrics.registry.MustRegister(t.sinceTxBlock)
+	}
+}
+
+// recordSignagePointTiming records the interval since the previous signage point
+func (s *FullNodeServiceMetrics) recordSignagePointTiming() {
+	t := &s.timer
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	if !t.lastSignagePoint.IsZero() {
+		s.signagePointInterval.Observe(now.Sub(t.lastSignagePoint).Seconds())
+	}
+	t.lastSignagePoint = now
+}
+
+// resetTiming forgets the last events, so time spent disconnected isn't recorded as an interval
+func (s *FullNodeServiceMetrics) resetTiming() {
+	t := &s.timer
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.lastBlock = time.Time{}
+	t.lastTxBlock = time.Time{}
+	t.lastSignagePoint = time.Time{}
+	if t.sinceTxBlockRegistered {
+		t.sinceTxBlockRegistered = false
+		s.metrics.registry.Unregister(t.sinceTxBlock)
+	}
+}
@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/forks-lab/go-stai-libs/pkg/bech32m"
+	"github.com/forks-lab/go-stai-libs/pkg/rpcinterface"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Balances of watch-only addresses, from the full node's coin records, are in this file
+
+// watchedAddress is an address or puzzle hash to report the balance of, without the wallet holding its keys
+type watchedAddress struct {
+	// Name is used as a label to identify the address. Defaults to the address
+	Name string `mapstructure:"name"`
+
+	// Address is a bech32m address, or a hex puzzle hash
+	Address string `mapstructure:"address"`
+
+	puzzleHash string
+
+	// lastReceived is the highest height a coin was received at, so only newer spent coins need to be fetched
+	lastReceived uint32
+}
+
+// coinRecordsByPuzzleHashOptions are the options for get_coin_records_by_puzzle_hash on the full node
+type coinRecordsByPuzzleHashOptions struct {
+	PuzzleHash        string `json:"puzzle_hash"`
+	StartHeight       uint32 `json:"start_height,omitempty"`
+	IncludeSpentCoins bool   `json:"include_spent_coins"`
+}
+
+// coinRecordsResponse is the response from the get_coin_records_by_* endpoints on the full node
+type coinRecordsResponse struct {
+	Success     bool          `json:"success"`
+	Error       string        `json:"error"`
+	CoinRecords []*coinRecord `json:"coin_records"`
+}
+
+// initWatchOnlyMetrics sets up the watch-only address metrics
+func (s *FullNodeServiceMetrics) initWatchOnlyMetrics() {
+	labels := []string{"name", "address"}
+	s.watchAddressBalance = s.metrics.newGaugeVec(staiServiceFullNode, "watch_address_balance", "Total amount of the unspent coins for the watch-only address, in mojos", labels)
+	s.watchAddressUnspentCoins = s.metrics.newGaugeVec(staiServiceFullNode, "watch_address_unspent_coin_count", "Number of unspent coins for the watch-only address", labels)
+	s.watchAddressLastReceived = s.metrics.newGaugeVec(staiServiceFullNode, "watch_address_last_received_height", "Height of the most recent coin received by the watch-only address, including coins that have been spent", labels)
+}
+
+// resetWatchOnlyMetrics clears the watch-only address metrics
+func (s *FullNodeServiceMetrics) resetWatchOnlyMetrics() {
+	s.watchAddressBalance.Reset()
+	s.watchAddressUnspentCoins.Reset()
+	s.watchAddressLastReceived.Reset()
+}
+
+// watchAddresses reads the addresses from the watch-addresses config and starts refreshing their balances
+func (s *FullNodeServiceMetrics) watchAddresses() {
+	var configured []*watchedAddress
+	err := viper.UnmarshalKey("watch-addresses", &configured)
+	if err != nil {
+		log.Errorf("Error reading watch-addresses config: %s\n", err.Error())
+		return
+	}
+
+	var addresses []*watchedAddress
+	for _, address := range configured {
+		if address == nil || address.Address == "" {
+			continue
+		}
+		address.puzzleHash, err = parsePuzzleHash(address.Address)
+		if err != nil {
+			log.Errorf("Invalid watch-only address %s: %s\n", address.Address, err.Error())
+			continue
+		}
+		if address.Name == "" {
+			address.Name = address.Address
+		}
+		addresses = append(addresses, address)
+	}
+	if len(addresses) == 0 {
+		return
+	}
+
+	startPolling(viper.GetDuration("watch-address-interval"), func() {
+		for _, address := range addresses {
+			s.RefreshAddress(address)
+		}
+	})
+}
+
+// parsePuzzleHash returns the hex puzzle hash for a bech32m address or a hex puzzle hash
+func parsePuzzleHash(address string) (string, error) {
+	trimmed := strings.TrimPrefix(strings.ToLower(address), "0x")
+	if len(trimmed) == 64 {
+		if _, err := hex.DecodeString(trimmed); err == nil {
+			return "0x" + trimmed, nil
+		}
+	}
+
+	puzzleHash, err := bech32m.DecodePuzzleHash(address)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("0x%x", puzzleHash), nil
+}
+
+// RefreshAddress asks the full node for the coins of a watch-only address and updates its metrics
+// Spent coins are only needed for the last received height, so only ones newer than the last poll are fetched
+func (s *FullNodeServiceMetrics) RefreshAddress(address *watchedAddress) {
+	unspent, err := s.coinRecordsByPuzzleHash(&coinRecordsByPuzzleHashOptions{PuzzleHash: address.puzzleHash})
+	if err != nil {
+		log.Debugf("Could not get coin records for %s: %s\n", address.Name, err.Error())
+		return
+	}
+	all, err := s.coinRecordsByPuzzleHash(&coinRecordsByPuzzleHashOptions{
+		PuzzleHash:        address.puzzleHash,
+		StartHeight:       address.lastReceived,
+		IncludeSpentCoins: true,
+	})
+	if err != nil {
+		log.Debugf("Could not get spent coin records for %s: %s\n", address.Name, err.Error())
+		return
+	}
+
+	balance := 0.0
+	for _, record := range unspent {
+		if record != nil {
+			balance += float64(record.Coin.Amount.Uint64())
+		}
+	}
+	for _, record := range all {
+		if record != nil && record.ConfirmedBlockIndex > address.lastReceived {
+			address.lastReceived = record.ConfirmedBlockIndex
+		}
+	}
+
+	s.watchAddressBalance.WithLabelValues(address.Name, address.Address).Set(balance)
+	s.watchAddressUnspentCoins.WithLabelValues(address.Name, address.Address).Set(float64(len(unspent)))
+	if address.lastReceived > 0 {
+		s.watchAddressLastReceived.WithLabelValues(address.Name, address.Address).Set(float64(address.lastReceived))
+	}
+}
+
+// coinRecordsByPuzzleHash returns coin records for a puzzle hash from the full node
+func (s *FullNodeServiceMetrics) coinRecordsByPuzzleHash(opts *coinRecordsByPuzzleHashOptions) ([]*coinRecord, error) {
+	records := &coinRecordsResponse{}
+	err := s.metrics.httpRequest(rpcinterface.ServiceFullNode, "get_coin_records_by_puzzle_hash", opts, records)
+	if err != nil {
+		return nil, err
+	}
+	if !records.Success {
+		return nil, fmt.Errorf("%s", records.Error)
+	}
+	return records.CoinRecords, nil
+}
@@ -3,11 +3,16 @@ package metrics
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/forks-lab/go-stai-libs/pkg/rpc"
 	"github.com/forks-lab/go-stai-libs/pkg/types"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 
 	wrappedPrometheus "github.com/forks-lab/stai-exporter/internal/prometheus"
 )
@@ -31,6 +36,38 @@ type HarvesterServiceMetrics struct {
 	totalEligiblePlots *wrappedPrometheus.LazyCounter
 	lastEligiblePlots  *wrappedPrometheus.LazyGauge
 	lastLookupTime     *wrappedPrometheus.LazyGauge
+
+	// Slow Lookup Metrics
+	slowLookupThreshold      float64
+	slowLookups              *wrappedPrometheus.LazyCounter
+	slowSignagePointsPercent *wrappedPrometheus.LazyGauge
+
+	// recentLookups is a ring buffer of whether each of the most recent lookups was slow
+	recentLookups     []bool
+	recentLookupsNext int
+	recentLookupsFull bool
+
+	// slowLookupLog holds the most recent slow lookups, for the slow lookups endpoint
+	slowLookupLog     []*slowLookup
+	slowLookupLogSize int
+	slowLookupLogLock sync.Mutex
+}
+
+// farmingInfoEvent is the harvester farming_info event, with the signage point that is not present in the go-stai-libs type
+type farmingInfoEvent struct {
+	types.EventHarvesterFarmingInfo
+	SignagePoint string `json:"signage_point"`
+}
+
+// slowLookup is a single lookup that took longer than the slow lookup threshold
+type slowLookup struct {
+	Timestamp     time.Time `json:"timestamp"`
+	ChallengeHash string    `json:"challenge_hash"`
+	SignagePoint  string    `json:"signage_point"`
+	TotalPlots    uint64    `json:"total_plots"`
+	EligiblePlots uint64    `json:"eligible_plots"`
+	FoundProofs   uint64    `json:"found_proofs"`
+	Time          float64   `json:"time"`
 }
 
 // InitMetrics sets all the metrics properties
@@ -46,6 +83,22 @@ func (s *HarvesterServiceMetrics) InitMetrics() {
 	s.lastEligiblePlots = s.metrics.newGauge(staiServiceHarvester, "last_eligible_plots", "Number of eligible plots for the last farmer_info event")
 
 	s.lastLookupTime = s.metrics.newGauge(staiServiceHarvester, "last_lookup_time", "Lookup time for the last farmer_info event")
+
+	s.slowLookupThreshold = viper.GetDuration("harvester-slow-lookup-threshold").Seconds()
+	s.slowLookups = s.metrics.newCounter(staiServiceHarvester, "slow_lookups", "Counter of lookups that took longer than the slow lookup threshold since the exporter started")
+	s.slowSignagePointsPercent = s.metrics.newGauge(staiServiceHarvester, "slow_signage_points_percent", "Percentage of the most recent signage points where the lookup took longer than the slow lookup threshold")
+
+	window := viper.GetInt("harvester-slow-lookup-window")
+	if window < 1 {
+		window = 1
+	}
+	s.recentLookups = make([]bool, window)
+	s.slowLookupLogSize = viper.GetInt("harvester-slow-lookup-log-size")
+}
+
+// RegisterEndpoints adds the slow lookups endpoint to the metrics server
+func (s *HarvesterServiceMetrics) RegisterEndpoints(mux *http.ServeMux) {
+	mux.HandleFunc("/harvester/slow-lookups", s.slowLookupsEndpoint)
 }
 
 // InitialData is called on startup of the metrics server, to allow seeding metrics with current/initial data
@@ -73,6 +126,7 @@ func (s *HarvesterServiceMetrics) Disconnected() {
 	s.lastFoundProofs.Unregister()
 	s.lastEligiblePlots.Unregister()
 	s.lastLookupTime.Unregister()
+	s.slowSignagePointsPercent.Unregister()
 }
 
 // Reconnected is called when the service is reconnected after the websocket was disconnected
@@ -92,7 +146,7 @@ func (s *HarvesterServiceMetrics) ReceiveResponse(resp *types.WebsocketResponse)
 
 // FarmingInfo handles the farming_info event from the harvester
 func (s *HarvesterServiceMetrics) FarmingInfo(resp *types.WebsocketResponse) {
-	info := &types.EventHarvesterFarmingInfo{}
+	info := &farmingInfoEvent{}
 	err := json.Unmarshal(resp.Data, info)
 	if err != nil {
 		log.Errorf("Error unmarshalling: %s\n", err.Error())
@@ -114,6 +168,74 @@ func (s *HarvesterServiceMetrics) FarmingInfo(resp *types.WebsocketResponse) {
 	s.lastEligiblePlots.Set(float64(info.EligiblePlots))
 
 	s.lastLookupTime.Set(info.Time)
+
+	s.trackLookupTime(info)
+}
+
+// trackLookupTime records whether the lookup was slow, and keeps details of slow lookups for the slow lookups endpoint
+func (s *HarvesterServiceMetrics) trackLookupTime(info *farmingInfoEvent) {
+	slow := info.Time > s.slowLookupThreshold
+
+	s.recentLookups[s.recentLookupsNext] = slow
+	s.recentLookupsNext = (s.recentLookupsNext + 1) % len(s.recentLookups)
+	if s.recentLookupsNext == 0 {
+		s.recentLookupsFull = true
+	}
+
+	total := s.recentLookupsNext
+	if s.recentLookupsFull {
+		total = len(s.recentLookups)
+	}
+	slowCount := 0
+	for _, wasSlow := range s.recentLookups[:total] {
+		if wasSlow {
+			slowCount++
+		}
+	}
+	s.slowSignagePointsPercent.Set(float64(slowCount) / float64(total) * 100)
+
+	if !slow {
+		return
+	}
+
+	log.Warnf("Harvester lookup took %.2f seconds for signage point %s. %d plots were eligible and %d proofs were found\n", info.Time, info.SignagePoint, info.EligiblePlots, info.FoundProofs)
+	s.slowLookups.Inc()
+
+	if s.slowLookupLogSize <= 0 {
+		return
+	}
+	s.slowLookupLogLock.Lock()
+	defer s.slowLookupLogLock.Unlock()
+	s.slowLookupLog = append(s.slowLookupLog, &slowLookup{
+		Timestamp:     time.Now(),
+		ChallengeHash: info.ChallengeHash,
+		SignagePoint:  info.SignagePoint,
+		TotalPlots:    info.TotalPlots,
+		EligiblePlots: info.EligiblePlots,
+		FoundProofs:   info.FoundProofs,
+		Time:          info.Time,
+	})
+	if len(s.slowLookupLog) > s.slowLookupLogSize {
+		s.slowLookupLog = s.slowLookupLog[len(s.slowLookupLog)-s.slowLookupLogSize:]
+	}
+}
+
+// slowLookupsEndpoint returns the most recent slow lookups as json, slowest first
+func (s *HarvesterServiceMetrics) slowLookupsEndpoint(w http.ResponseWriter, r *http.Request) {
+	s.slowLookupLogLock.Lock()
+	lookups := make([]*slowLookup, len(s.slowLookupLog))
+	copy(lookups, s.slowLookupLog)
+	s.slowLookupLogLock.Unlock()
+
+	sort.Slice(lookups, func(i, j int) bool {
+		return lookups[i].Time > lookups[j].Time
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(lookups)
+	if err != nil {
+		log.Errorf("Error writing slow lookups response %s\n", err.Error())
+	}
 }
 
 // GetPlots handles a get_plots rpc response
@@ -137,9 +259,11 @@ func (s *HarvesterServiceMetrics) ProcessGetPlots(plots *rpc.HarvesterGetPlotsRe
 
 	plotSize := map[uint8]map[plotType]uint64{}
 	plotCount := map[uint8]map[plotType]uint64{}
+	effectiveSpace := float64(0)
 
 	for _, plot := range plots.Plots {
 		kSize := plot.Size
+		effectiveSpace += effectivePlotSize(kSize)
 
 		if _, ok := plotSize[kSize]; !ok {
 			plotSize[kSize] = map[plotType]uint64{
@@ -179,4 +303,6 @@ func (s *HarvesterServiceMetrics) ProcessGetPlots(plots *rpc.HarvesterGetPlotsRe
 	s.totalPlots.Set(float64(totalPlotCount))
 
 	s.totalPlotsValue = uint64(totalPlotCount)
+
+	s.metrics.estimateMetrics.SetEffectivePlotSpace(effectiveSpace)
 }
@@ -0,0 +1,286 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/forks-lab/go-stai-libs/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Metrics parsed from the STAI log file are in this file
+
+// logPollInterval is how often the log file is checked for new lines and rotation
+const logPollInterval = time.Second
+
+// defaultLogFilename is the log file used when the STAI config doesn't set logging.log_filename
+const defaultLogFilename = "log/debug.log"
+
+var (
+	// logLineRegex matches a STAI log line, capturing the module and level
+	// 2022-01-01T12:00:00.000 harvester stai.harvester.harvester: INFO     1 plots were eligible for farming ...
+	logLineRegex = regexp.MustCompile(`^\S+ \S+ (\S+?)\s*: +(DEBUG|INFO|WARNING|ERROR|CRITICAL)\s+(.*)$`)
+
+	// lookupTimeRegex matches the time taken for all plots that passed the filter for a signage point
+	lookupTimeRegex = regexp.MustCompile(`plots were eligible for farming.* Time: ([0-9.]+) s`)
+
+	// slowPlotLookupRegex matches the warning logged when looking up qualities for a single plot is slow
+	slowPlotLookupRegex = regexp.MustCompile(`Looking up qualities on .* took: ([0-9]+(?:\.[0-9]+)?)`)
+
+	// lookupTimeBuckets are the histogram buckets for lookup times, in seconds
+	lookupTimeBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 15, 20, 30, 60}
+)
+
+// logPattern counts log lines that match a regular expression
+type logPattern struct {
+	Name  string `mapstructure:"name"`
+	Regex string `mapstructure:"regex"`
+
+	regex *regexp.Regexp
+}
+
+// defaultLogPatterns are counted in addition to any patterns in the log-patterns config
+var defaultLogPatterns = []*logPattern{
+	{Name: "peer_banned", Regex: `(?i)\bbann(ed|ing)\b`},
+	{Name: "timeout", Regex: `(?i)\btime(d)? ?out\b`},
+}
+
+// LogMetrics contains metrics parsed from the lines of the STAI log file
+// These are not based on any RPC, so the log file is followed in the background
+type LogMetrics struct {
+	// Holds a reference to the main metrics container this is a part of
+	metrics *Metrics
+
+	patterns []*logPattern
+
+	// Log Metrics
+	lines           *prometheus.CounterVec
+	patternMatches  *prometheus.CounterVec
+	lookupTime      prometheus.Histogram
+	slowPlotLookups prometheus.Histogram
+}
+
+// InitMetrics sets all the metrics properties
+func (s *LogMetrics) InitMetrics() {
+	s.lines = s.metrics.newCounterVec(staiServiceLog, "lines_total", "Number of log lines, by level and module", []string{"level", "module"})
+	s.patternMatches = s.metrics.newCounterVec(staiServiceLog, "pattern_matches_total", "Number of log lines that match each configured pattern", []string{"pattern"})
+	s.lookupTime = s.metrics.newHistogram(staiServiceLog, "harvester_lookup_seconds", "Time the harvester took to look up qualities for all plots that passed the filter for a signage point, from the log", lookupTimeBuckets)
+	s.slowPlotLookups = s.metrics.newHistogram(staiServiceLog, "harvester_slow_plot_lookup_seconds", "Time taken by individual plot lookups that STAI warned were slow, from the log", lookupTimeBuckets)
+}
+
+// StartBackgroundTasks follows the STAI log file for the lifetime of the process, if enabled
+func (s *LogMetrics) StartBackgroundTasks() {
+	if !viper.GetBool("log-tail") {
+		return
+	}
+
+	path := viper.GetString("log-tail-path")
+	if path == "" {
+		var err error
+		path, err = staiLogPath()
+		if err != nil {
+			log.Errorf("Error finding STAI log file, log metrics are disabled: %s\n", err.Error())
+			return
+		}
+	}
+
+	var configured []*logPattern
+	err := viper.UnmarshalKey("log-patterns", &configured)
+	if err != nil {
+		log.Errorf("Error reading log-patterns config: %s\n", err.Error())
+	}
+	for _, pattern := range append(defaultLogPatterns, configured...) {
+		if pattern == nil || pattern.Name == "" {
+			continue
+		}
+		pattern.regex, err = regexp.Compile(pattern.Regex)
+		if err != nil {
+			log.Errorf("Error compiling log pattern %s: %s\n", pattern.Name, err.Error())
+			continue
+		}
+		s.patterns = append(s.patterns, pattern)
+	}
+
+	log.Infof("Following STAI log file %s\n", path)
+	go (&logTailer{path: path, handleLine: s.ProcessLine}).run()
+}
+
+// staiLogPath returns the path of the log file from the STAI config
+func staiLogPath() (string, error) {
+	cfg, err := config.GetStaiConfig()
+	if err != nil {
+		return "", err
+	}
+	v, err := readStaiConfigFile(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	filename := v.GetString("logging.log_filename")
+	if filename == "" {
+		filename = defaultLogFilename
+	}
+	return staiPath(cfg, filename), nil
+}
+
+// ProcessLine updates metrics for a single line from the log file
+func (s *LogMetrics) ProcessLine(line string) {
+	matches := logLineRegex.FindStringSubmatch(line)
+	if matches == nil {
+		// Continuation lines, such as tracebacks, don't have their own level and module
+		return
+	}
+	module, level, message := matches[1], matches[2], matches[3]
+
+	s.lines.WithLabelValues(strings.ToLower(level), module).Inc()
+
+	if lookup := lookupTimeRegex.FindStringSubmatch(message); lookup != nil {
+		if seconds, err := strconv.ParseFloat(lookup[1], 64); err == nil {
+			s.lookupTime.Observe(seconds)
+		}
+	}
+	if lookup := slowPlotLookupRegex.FindStringSubmatch(message); lookup != nil {
+		if seconds, err := strconv.ParseFloat(lookup[1], 64); err == nil {
+			s.slowPlotLookups.Observe(seconds)
+		}
+	}
+
+	for _, pattern := range s.patterns {
+		if pattern.regex.MatchString(message) {
+			s.patternMatches.WithLabelValues(pattern.Name).Inc()
+		}
+	}
+}
+
+// logTailer follows a log file, including when it is rotated or truncated
+type logTailer struct {
+	path       string
+	handleLine func(string)
+
+	file   *os.File
+	info   os.FileInfo
+	reader *bufio.Reader
+	offset int64
+
+	// partial holds the start of a line that hasn't been completely written yet
+	partial string
+}
+
+// run follows the log file forever. Existing lines are skipped, so only new lines are processed
+func (t *logTailer) run() {
+	skipExisting := true
+	for {
+		if t.file == nil {
+			err := t.open(skipExisting)
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					log.Errorf("Error opening log file %s: %s\n", t.path, err.Error())
+				}
+				time.Sleep(logPollInterval)
+				continue
+			}
+			skipExisting = false
+		}
+
+		t.readLines()
+		t.checkRotation()
+		time.Sleep(logPollInterval)
+	}
+}
+
+// open opens the log file, starting at the end if skipExisting is set
+func (t *logTailer) open(skipExisting bool) error {
+	file, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	t.offset = 0
+	if skipExisting {
+		t.offset, err = file.Seek(0, io.SeekEnd)
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+
+	t.file = file
+	t.info = info
+	t.reader = bufio.NewReader(file)
+	t.partial = ""
+	return nil
+}
+
+// readLines processes all complete lines written since the last read
+func (t *logTailer) readLines() {
+	for {
+		chunk, err := t.reader.ReadString('\n')
+		t.offset += int64(len(chunk))
+		if err != nil {
+			// Keep the incomplete line until the rest of it is written
+			t.partial += chunk
+			if !errors.Is(err, io.EOF) {
+				log.Errorf("Error reading log file %s: %s\n", t.path, err.Error())
+				t.close()
+			}
+			return
+		}
+
+		line := strings.TrimRight(t.partial+chunk, "\r\n")
+		t.partial = ""
+		t.handleLine(line)
+	}
+}
+
+// checkRotation reopens the log file if it was replaced or truncated. This is called after reading all lines from
+// the current file, so nothing written before rotation is missed
+func (t *logTailer) checkRotation() {
+	if t.file == nil {
+		return
+	}
+
+	info, err := os.Stat(t.path)
+	if err != nil {
+		// The file was moved and the new one doesn't exist yet, so keep the old file until it does
+		return
+	}
+
+	if !os.SameFile(t.info, info) {
+		log.Debugf("Log file %s was rotated\n", t.path)
+		t.close()
+		return
+	}
+
+	if info.Size() < t.offset {
+		log.Debugf("Log file %s was truncated\n", t.path)
+		_, err = t.file.Seek(0, io.SeekStart)
+		if err != nil {
+			t.close()
+			return
+		}
+		t.offset = 0
+		t.reader.Reset(t.file)
+		t.partial = ""
+	}
+}
+
+// close closes the current log file, so it is opened again on the next poll
+func (t *logTailer) close() {
+	if t.file != nil {
+		_ = t.file.Close()
+	}
+	t.file = nil
+}
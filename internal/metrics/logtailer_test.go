@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestLogLineRegex(t *testing.T) {
+	tests := []struct {
+		name        string
+		line        string
+		wantMatch   bool
+		wantModule  string
+		wantLevel   string
+		wantMessage string
+	}{
+		{
+			name:        "info line",
+			line:        "2022-01-01T12:00:00.000 harvester stai.harvester.harvester: INFO     1 plots were eligible for farming abc... Found 0 proofs. Time: 0.12345 s. Total 10 plots",
+			wantMatch:   true,
+			wantModule:  "stai.harvester.harvester",
+			wantLevel:   "INFO",
+			wantMessage: "1 plots were eligible for farming abc... Found 0 proofs. Time: 0.12345 s. Total 10 plots",
+		},
+		{
+			name:        "warning line",
+			line:        "2022-01-01T12:00:00.000 full_node stai.full_node.full_node: WARNING  Peer timed out",
+			wantMatch:   true,
+			wantModule:  "stai.full_node.full_node",
+			wantLevel:   "WARNING",
+			wantMessage: "Peer timed out",
+		},
+		{
+			name:      "traceback continuation",
+			line:      "Traceback (most recent call last):",
+			wantMatch: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches := logLineRegex.FindStringSubmatch(tt.line)
+			if (matches != nil) != tt.wantMatch {
+				t.Fatalf("matched = %t, want %t", matches != nil, tt.wantMatch)
+			}
+			if matches == nil {
+				return
+			}
+			if matches[1] != tt.wantModule {
+				t.Errorf("module = %q, want %q", matches[1], tt.wantModule)
+			}
+			if matches[2] != tt.wantLevel {
+				t.Errorf("level = %q, want %q", matches[2], tt.wantLevel)
+			}
+			if matches[3] != tt.wantMessage {
+				t.Errorf("message = %q, want %q", matches[3], tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestLookupTimeRegexes(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		regex   *regexp.Regexp
+		want    string
+	}{
+		{
+			name:    "lookup time",
+			message: "1 plots were eligible for farming 3c9a1f2b... Found 0 proofs. Time: 0.54321 s. Total 100 plots",
+			regex:   lookupTimeRegex,
+			want:    "0.54321",
+		},
+		{
+			name:    "slow plot lookup",
+			message: "Looking up qualities on /plots/plot-k32-2022.plot took: 7.5. This should be below 5 seconds to minimize risk of losing rewards.",
+			regex:   slowPlotLookupRegex,
+			want:    "7.5",
+		},
+		{
+			name:    "slow plot lookup in whole seconds",
+			message: "Looking up qualities on /plots/plot-k32-2022.plot took: 12",
+			regex:   slowPlotLookupRegex,
+			want:    "12",
+		},
+		{
+			name:    "unrelated message",
+			message: "Farmer connected",
+			regex:   lookupTimeRegex,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			if matches := tt.regex.FindStringSubmatch(tt.message); matches != nil {
+				got = matches[1]
+			}
+			if got != tt.want {
+				t.Errorf("seconds = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,13 +3,16 @@ package metrics
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/forks-lab/go-stai-libs/pkg/rpc"
+	"github.com/forks-lab/go-stai-libs/pkg/rpcinterface"
 	"github.com/forks-lab/go-stai-libs/pkg/types"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
 
 	wrappedPrometheus "github.com/forks-lab/stai-exporter/internal/prometheus"
 )
@@ -23,6 +26,18 @@ const (
 	staiServiceTimelord  staiService = "timelord"
 	staiServiceHarvester staiService = "harvester"
 	staiServiceFarmer    staiService = "farmer"
+
+	// staiServiceFilesystem is not a STAI service, but is used as the subsystem for filesystem metrics
+	staiServiceFilesystem staiService = "filesystem"
+
+	// staiServiceEstimates is not a STAI service, but is used as the subsystem for metrics derived from multiple services
+	staiServiceEstimates staiService = "estimates"
+
+	// staiServiceFiles is not a STAI service, but is used as the subsystem for file and directory size metrics
+	staiServiceFiles staiService = "files"
+
+	// staiServiceLog is not a STAI service, but is used as the subsystem for metrics parsed from the STAI log file
+	staiServiceLog staiService = "log"
 )
 
 // serviceMetrics defines methods that must be on all metrics services
@@ -44,6 +59,19 @@ type serviceMetrics interface {
 	Reconnected()
 }
 
+// endpointProvider is implemented by services that serve additional data on the metrics server
+type endpointProvider interface {
+	// RegisterEndpoints adds any http handlers for the service to the metrics server
+	RegisterEndpoints(mux *http.ServeMux)
+}
+
+// backgroundTaskRunner is implemented by services that poll for data on an interval, rather than only in response
+// to websocket events
+type backgroundTaskRunner interface {
+	// StartBackgroundTasks starts any polling for the service. This is only called once for the lifetime of the process
+	StartBackgroundTasks()
+}
+
 // Metrics is the main entrypoint
 type Metrics struct {
 	metricsPort uint16
@@ -54,11 +82,26 @@ type Metrics struct {
 	// websocket connection or needs to be paginated
 	httpClient *rpc.Client
 
+	// Limits how often requests are sent in response to websocket events
+	scheduler *requestScheduler
+
 	// This holds a custom prometheus registry so that only our metrics are exported, and not the default go metrics
 	registry *prometheus.Registry
 
 	// All the serviceMetrics interfaces that are registered
 	serviceMetrics map[staiService]serviceMetrics
+
+	// Metrics for the filesystems STAI data is stored on, which are not tied to the websocket connection
+	filesystemMetrics *FilesystemMetrics
+
+	// Metrics that combine data from the full node and harvester
+	estimateMetrics *EstimateMetrics
+
+	// Metrics for the size of files and directories, which are not tied to the websocket connection
+	fileWatcher *FileWatcherMetrics
+
+	// Metrics parsed from the STAI log file, which are not tied to the websocket connection
+	logMetrics *LogMetrics
 }
 
 // NewMetrics returns a new instance of metrics
@@ -70,6 +113,7 @@ func NewMetrics(port uint16, logLevel log.Level) (*Metrics, error) {
 		metricsPort:    port,
 		registry:       prometheus.NewRegistry(),
 		serviceMetrics: map[staiService]serviceMetrics{},
+		scheduler:      newRequestScheduler(),
 	}
 
 	log.SetLevel(logLevel)
@@ -95,11 +139,24 @@ func NewMetrics(port uint16, logLevel log.Level) (*Metrics, error) {
 	metrics.serviceMetrics[staiServiceHarvester] = &HarvesterServiceMetrics{metrics: metrics}
 	metrics.serviceMetrics[staiServiceFarmer] = &FarmerServiceMetrics{metrics: metrics}
 
+	// Services can add paths to the file watcher, so it must exist before they start
+	metrics.fileWatcher = &FileWatcherMetrics{metrics: metrics}
+	metrics.fileWatcher.InitMetrics()
+
 	// Init each service's metrics
 	for _, service := range metrics.serviceMetrics {
 		service.InitMetrics()
 	}
 
+	metrics.filesystemMetrics = &FilesystemMetrics{metrics: metrics}
+	metrics.filesystemMetrics.InitMetrics()
+
+	metrics.estimateMetrics = &EstimateMetrics{metrics: metrics}
+	metrics.estimateMetrics.InitMetrics()
+
+	metrics.logMetrics = &LogMetrics{metrics: metrics}
+	metrics.logMetrics.InitMetrics()
+
 	return metrics, nil
 }
 
@@ -174,6 +231,46 @@ func (m *Metrics) newCounterVec(service staiService, name string, help string, l
 	return gm
 }
 
+// newHistogram returns a histogram that follows naming conventions and registers it with the prometheus collector
+func (m *Metrics) newHistogram(service staiService, name string, help string, buckets []float64) prometheus.Histogram {
+	opts := prometheus.HistogramOpts{
+		Namespace: "stai",
+		Subsystem: string(service),
+		Name:      name,
+		Help:      help,
+		Buckets:   buckets,
+	}
+
+	hm := prometheus.NewHistogram(opts)
+
+	m.registry.MustRegister(hm)
+
+	return hm
+}
+
+// newSnapshotHistogram returns a histogram of the latest set of values that follows naming conventions
+// It is registered with the prometheus collector the first time values are set
+func (m *Metrics) newSnapshotHistogram(service staiService, name string, help string, buckets []float64) *wrappedPrometheus.SnapshotHistogram {
+	return &wrappedPrometheus.SnapshotHistogram{
+		Desc:     prometheus.NewDesc(prometheus.BuildFQName("stai", string(service), name), help, nil, nil),
+		Buckets:  buckets,
+		Registry: m.registry,
+	}
+}
+
+// newSnapshotHistogramVec returns a histogram of the latest set of values for each label value that follows naming
+// conventions and registers it with the prometheus collector
+func (m *Metrics) newSnapshotHistogramVec(service staiService, name string, help string, buckets []float64, labels []string) *wrappedPrometheus.SnapshotHistogramVec {
+	hv := &wrappedPrometheus.SnapshotHistogramVec{
+		Desc:    prometheus.NewDesc(prometheus.BuildFQName("stai", string(service), name), help, labels, nil),
+		Buckets: buckets,
+	}
+
+	m.registry.MustRegister(hv)
+
+	return hv
+}
+
 // OpenWebsocket sets up the RPC client and subscribes to relevant topics
 func (m *Metrics) OpenWebsocket() error {
 	err := m.client.SubscribeSelf()
@@ -186,6 +283,14 @@ func (m *Metrics) OpenWebsocket() error {
 		return err
 	}
 
+	// The wallet only sends transaction updates to the wallet UI
+	if viper.GetDuration("wallet-transaction-interval") > 0 {
+		err = m.client.Subscribe("wallet_ui")
+		if err != nil {
+			return err
+		}
+	}
+
 	err = m.client.AddHandler(m.websocketReceive)
 	if err != nil {
 		return err
@@ -201,6 +306,71 @@ func (m *Metrics) OpenWebsocket() error {
 	return nil
 }
 
+// StartBackgroundTasks starts any tasks that run on an interval for the lifetime of the process
+// These do not depend on the websocket connection, so are only started once
+func (m *Metrics) StartBackgroundTasks() {
+	m.filesystemMetrics.StartBackgroundTasks()
+	m.logMetrics.StartBackgroundTasks()
+	for _, service := range m.serviceMetrics {
+		if runner, ok := service.(backgroundTaskRunner); ok {
+			runner.StartBackgroundTasks()
+		}
+	}
+
+	// Started last, so it includes any paths added by services
+	m.fileWatcher.StartBackgroundTasks()
+}
+
+// startPolling calls poll in the background every interval, for the lifetime of the process
+// An interval of 0 or less disables polling
+func startPolling(interval time.Duration, poll func()) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			poll()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// websocketRequest sends an RPC request over the websocket for endpoints that don't have a helper in go-stai-libs
+// The response is handled in ReceiveResponse of the service, the same as any other websocket response
+func (m *Metrics) websocketRequest(service rpcinterface.ServiceType, endpoint rpcinterface.Endpoint, opts interface{}) error {
+	req, err := m.client.NewRequest(service, endpoint, opts)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.client.Do(req, nil)
+	return err
+}
+
+// httpRequest makes an RPC request with the http client and decodes the response into v
+// This is used for RPC endpoints that don't have a helper in go-stai-libs
+func (m *Metrics) httpRequest(service rpcinterface.ServiceType, endpoint rpcinterface.Endpoint, opts interface{}, v interface{}) error {
+	if m.httpClient == nil {
+		return fmt.Errorf("http client is not available")
+	}
+
+	req, err := m.httpClient.NewRequest(service, endpoint, opts)
+	if err != nil {
+		return err
+	}
+
+	resp, err := m.httpClient.Do(req, v)
+	if resp != nil {
+		// The body is not closed by the client, and we poll some endpoints often enough that this matters
+		closeErr := resp.Body.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
 // CloseWebsocket closes the websocket connection
 func (m *Metrics) CloseWebsocket() error {
 	// @TODO reenable once fixed in the upstream dep
@@ -214,6 +384,11 @@ func (m *Metrics) StartServer() error {
 
 	http.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
 	http.HandleFunc("/healthz", healthcheckEndpoint)
+	for _, service := range m.serviceMetrics {
+		if provider, ok := service.(endpointProvider); ok {
+			provider.RegisterEndpoints(http.DefaultServeMux)
+		}
+	}
 	return http.ListenAndServe(fmt.Sprintf(":%d", m.metricsPort), nil)
 }
 
@@ -226,6 +401,12 @@ func (m *Metrics) websocketReceive(resp *types.WebsocketResponse, err error) {
 	log.Printf("recv: %s %s\n", resp.Origin, resp.Command)
 	log.Debugf("origin: %s command: %s destination: %s data: %s\n", resp.Origin, resp.Command, resp.Destination, string(resp.Data))
 
+	// Services send many of the same events to the wallet UI as to metrics, so only wallet state changes are handled
+	// from the wallet UI subscription, to avoid processing events twice
+	if resp.Destination == "wallet_ui" && (resp.Origin != "stai_wallet" || resp.Command != "state_changed") {
+		return
+	}
+
 	switch resp.Origin {
 	case "stai_full_node":
 		m.serviceMetrics[staiServiceFullNode].ReceiveResponse(resp)
@@ -247,6 +428,7 @@ func (m *Metrics) disconnectHandler() {
 	for _, service := range m.serviceMetrics {
 		service.Disconnected()
 	}
+	m.estimateMetrics.Unregister()
 }
 
 func (m *Metrics) reconnectHandler() {
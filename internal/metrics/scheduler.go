@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// defaultRequestIntervals are the minimum times between identical requests that are sent in response to events, for
+// each command. These can be overridden with request-min-intervals
+var defaultRequestIntervals = map[string]time.Duration{
+	"get_sync_status":         5 * time.Second,
+	"get_wallet_balance":      5 * time.Second,
+	"get_connections":         15 * time.Second,
+	"get_block_count_metrics": 60 * time.Second,
+}
+
+// requestScheduler limits how often identical requests are sent in response to events
+// The first request is sent right away. Requests within the minimum interval of the last one are coalesced into a
+// single request, sent once the interval has passed, so the last event in a burst is always followed by fresh data
+type requestScheduler struct {
+	lock      sync.Mutex
+	intervals map[string]time.Duration
+	requests  map[string]*scheduledRequest
+}
+
+// scheduledRequest tracks the last time a request was sent, and the request waiting to be sent, if any
+type scheduledRequest struct {
+	lastSent time.Time
+	pending  func() error
+}
+
+// newRequestScheduler returns a scheduler using the default intervals and any configured in request-min-intervals
+func newRequestScheduler() *requestScheduler {
+	intervals := map[string]time.Duration{}
+	for command, interval := range defaultRequestIntervals {
+		intervals[command] = interval
+	}
+	for command, configured := range viper.GetStringMapString("request-min-intervals") {
+		interval, err := time.ParseDuration(configured)
+		if err != nil {
+			log.Errorf("Invalid interval for %s in request-min-intervals: %s\n", command, err.Error())
+			continue
+		}
+		intervals[command] = interval
+	}
+
+	return &requestScheduler{
+		intervals: intervals,
+		requests:  map[string]*scheduledRequest{},
+	}
+}
+
+// Request sends a request for command, or schedules it to be sent once the minimum interval for the command has
+// passed. key identifies identical requests, and should include any options, such as the wallet id
+func (r *requestScheduler) Request(command string, key string, send func() error) {
+	interval := r.intervals[command]
+	if interval <= 0 {
+		logRequestErr(send())
+		return
+	}
+
+	r.lock.Lock()
+	request, ok := r.requests[key]
+	if !ok {
+		request = &scheduledRequest{}
+		r.requests[key] = request
+	}
+	if request.pending != nil {
+		// Already waiting to be sent, so this request is coalesced into that one
+		request.pending = send
+		r.lock.Unlock()
+		return
+	}
+	wait := time.Until(request.lastSent.Add(interval))
+	if wait <= 0 {
+		request.lastSent = time.Now()
+		r.lock.Unlock()
+		logRequestErr(send())
+		return
+	}
+	request.pending = send
+	r.lock.Unlock()
+
+	log.Debugf("Delaying %s for %s\n", key, wait)
+	time.AfterFunc(wait, func() {
+		r.lock.Lock()
+		pending := request.pending
+		request.pending = nil
+		request.lastSent = time.Now()
+		r.lock.Unlock()
+
+		logRequestErr(pending())
+	})
+}
+
+// logRequestErr logs an error from sending a scheduled request
+func logRequestErr(err error) {
+	if err != nil {
+		log.Errorf("%s\n", err.Error())
+	}
+}
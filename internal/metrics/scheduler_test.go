@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testInterval is the minimum interval between requests in the scheduler tests
+const testInterval = 50 * time.Millisecond
+
+// sentRequests records the requests sent by a scheduler in tests
+type sentRequests struct {
+	lock sync.Mutex
+	sent []string
+}
+
+// send returns a request that records name when it is sent
+func (r *sentRequests) send(name string) func() error {
+	return func() error {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.sent = append(r.sent, name)
+		return nil
+	}
+}
+
+// get returns the requests sent so far
+func (r *sentRequests) get() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.sent...)
+}
+
+func newTestScheduler() *requestScheduler {
+	return &requestScheduler{
+		intervals: map[string]time.Duration{"get_sync_status": testInterval},
+		requests:  map[string]*scheduledRequest{},
+	}
+}
+
+func TestRequestSchedulerFirstRequestIsImmediate(t *testing.T) {
+	scheduler := newTestScheduler()
+	requests := &sentRequests{}
+
+	scheduler.Request("get_sync_status", "get_sync_status", requests.send("first"))
+
+	if sent := requests.get(); len(sent) != 1 || sent[0] != "first" {
+		t.Errorf("sent = %v, want [first]", sent)
+	}
+}
+
+func TestRequestSchedulerCoalescesRequests(t *testing.T) {
+	scheduler := newTestScheduler()
+	requests := &sentRequests{}
+
+	scheduler.Request("get_sync_status", "get_sync_status", requests.send("first"))
+	scheduler.Request("get_sync_status", "get_sync_status", requests.send("second"))
+	scheduler.Request("get_sync_status", "get_sync_status", requests.send("third"))
+
+	if sent := requests.get(); len(sent) != 1 {
+		t.Fatalf("sent within the interval = %v, want only the first request", sent)
+	}
+
+	time.Sleep(3 * testInterval)
+
+	sent := requests.get()
+	if len(sent) != 2 {
+		t.Fatalf("sent = %v, want the first request and one delayed request", sent)
+	}
+	if sent[1] != "third" {
+		t.Errorf("delayed request = %s, want the last request, third", sent[1])
+	}
+}
+
+func TestRequestSchedulerSeparateKeys(t *testing.T) {
+	scheduler := newTestScheduler()
+	requests := &sentRequests{}
+
+	scheduler.Request("get_sync_status", "wallet 1", requests.send("wallet 1"))
+	scheduler.Request("get_sync_status", "wallet 2", requests.send("wallet 2"))
+
+	if sent := requests.get(); len(sent) != 2 {
+		t.Errorf("sent = %v, want both requests right away", sent)
+	}
+}
+
+func TestRequestSchedulerNoInterval(t *testing.T) {
+	scheduler := newTestScheduler()
+	requests := &sentRequests{}
+
+	scheduler.Request("get_blockchain_state", "get_blockchain_state", requests.send("first"))
+	scheduler.Request("get_blockchain_state", "get_blockchain_state", requests.send("second"))
+
+	if sent := requests.get(); len(sent) != 2 {
+		t.Errorf("sent = %v, want both requests right away", sent)
+	}
+}
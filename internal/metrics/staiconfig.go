@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"path/filepath"
+
+	"github.com/forks-lab/go-stai-libs/pkg/config"
+	"github.com/spf13/viper"
+)
+
+// readStaiConfigFile loads the STAI config.yaml into a standalone viper instance
+// This is used to read values that are not part of the config struct from go-stai-libs, such as plot directories
+func readStaiConfigFile(cfg *config.StaiConfig) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetConfigFile(cfg.GetFullPath(filepath.Join("config", "config.yaml")))
+	err := v.ReadInConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// staiPath returns the full path for a path from the STAI config
+// Paths in the config may be absolute, or relative to STAI_ROOT
+func staiPath(cfg *config.StaiConfig, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return cfg.GetFullPath(path)
+}
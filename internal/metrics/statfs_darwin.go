@@ -0,0 +1,11 @@
+//go:build darwin
+// +build darwin
+
+package metrics
+
+import "syscall"
+
+// statfsBlockSize returns the unit that block counts are reported in, which is the fundamental block size on darwin
+func statfsBlockSize(fs *syscall.Statfs_t) uint64 {
+	return uint64(fs.Bsize)
+}
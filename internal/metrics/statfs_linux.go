@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package metrics
+
+import "syscall"
+
+// statfsBlockSize returns the unit that block counts are reported in. On linux this is the fragment size, which can
+// differ from the preferred block size in Bsize on some filesystems
+func statfsBlockSize(fs *syscall.Statfs_t) uint64 {
+	if fs.Frsize > 0 {
+		return uint64(fs.Frsize)
+	}
+	return uint64(fs.Bsize)
+}
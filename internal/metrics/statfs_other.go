@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package metrics
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// statfsSupported indicates whether filesystem metrics can be collected on this platform
+const statfsSupported = false
+
+// statFilesystem is not supported on this platform
+func statFilesystem(path string) (*filesystemStats, error) {
+	return nil, fmt.Errorf("filesystem metrics are not supported on %s", runtime.GOOS)
+}
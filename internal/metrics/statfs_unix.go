@@ -0,0 +1,69 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package metrics
+
+import (
+	"path/filepath"
+	"syscall"
+)
+
+// statfsSupported indicates whether filesystem metrics can be collected on this platform
+const statfsSupported = true
+
+// statfsReadOnly is ST_RDONLY on linux and MNT_RDONLY on darwin, which share the same value
+const statfsReadOnly = 0x1
+
+// statFilesystem returns capacity information for the filesystem the path is stored on
+func statFilesystem(path string) (*filesystemStats, error) {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fs syscall.Statfs_t
+	err = syscall.Statfs(path, &fs)
+	if err != nil {
+		return nil, err
+	}
+
+	var st syscall.Stat_t
+	err = syscall.Stat(path, &st)
+	if err != nil {
+		return nil, err
+	}
+
+	blockSize := statfsBlockSize(&fs)
+
+	return &filesystemStats{
+		MountPoint: mountPoint(path, uint64(st.Dev)),
+		SizeBytes:  uint64(fs.Blocks) * blockSize,
+		FreeBytes:  uint64(fs.Bfree) * blockSize,
+		AvailBytes: uint64(fs.Bavail) * blockSize,
+		Inodes:     uint64(fs.Files),
+		InodesFree: uint64(fs.Ffree),
+		ReadOnly:   uint64(fs.Flags)&statfsReadOnly != 0,
+	}, nil
+}
+
+// mountPoint walks up the directory tree from path until the device changes, which is where the filesystem is mounted
+func mountPoint(path string, dev uint64) string {
+	for {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+
+		var st syscall.Stat_t
+		err := syscall.Stat(parent, &st)
+		if err != nil || uint64(st.Dev) != dev {
+			return path
+		}
+
+		path = parent
+	}
+}
@@ -3,12 +3,17 @@ package metrics
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"strings"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/forks-lab/go-stai-libs/pkg/rpc"
+	"github.com/forks-lab/go-stai-libs/pkg/rpcinterface"
 	"github.com/forks-lab/go-stai-libs/pkg/types"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
 
 	wrappedPrometheus "github.com/forks-lab/stai-exporter/internal/prometheus"
 	"github.com/forks-lab/stai-exporter/internal/utils"
@@ -16,11 +21,54 @@ import (
 
 // Metrics that are based on Wallet RPC calls are in this file
 
+// nativeAssetName is the asset name used for wallets that hold STAI rather than a CAT
+const nativeAssetName = "STAI"
+
+// walletTypeNames are the names used in the wallet_type_name label for each type of wallet
+var walletTypeNames = map[types.WalletType]string{
+	types.WalletTypeStandard:        "standard",
+	types.WalletTypeRateLimited:     "rate_limited",
+	types.WalletTypeAtomicSwap:      "atomic_swap",
+	types.WalletTypeAuthorizedPayee: "authorized_payee",
+	types.WalletTypeMultiSig:        "multi_sig",
+	types.WalletTypeCustody:         "custody",
+	types.WalletTypeCAT:             "cat",
+	types.WalletTypeRecoverable:     "recoverable",
+	types.WalletTypeDID:             "did",
+	types.WalletType(9):             "pool",
+	types.WalletType(10):            "nft",
+}
+
+// walletTypeName returns the name of a wallet type, or the number for types we don't know about
+func walletTypeName(walletType types.WalletType) string {
+	if name, ok := walletTypeNames[walletType]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", walletType)
+}
+
+// walletDecimals returns the number of decimal places in one whole coin of the asset held by a type of wallet
+// CATs are 1000 mojos per coin, and NFT and DID wallets hold singletons that don't have a meaningful whole coin unit
+func walletDecimals(walletType types.WalletType) int {
+	switch walletType {
+	case types.WalletTypeCAT:
+		return 3
+	case types.WalletTypeDID, types.WalletType(10):
+		return 0
+	default:
+		return 12
+	}
+}
+
 // WalletServiceMetrics contains all metrics related to the wallet
 type WalletServiceMetrics struct {
 	// Holds a reference to the main metrics container this is a part of
 	metrics *Metrics
 
+	// Wallet names from get_wallets, by wallet id
+	walletNamesLock sync.Mutex
+	walletNames     map[uint32]string
+
 	// WalletBalanceMetrics
 	walletSynced            *wrappedPrometheus.LazyGauge
 	confirmedBalance        *prometheus.GaugeVec
@@ -28,18 +76,107 @@ type WalletServiceMetrics struct {
 	maxSendAmount           *prometheus.GaugeVec
 	pendingCoinRemovalCount *prometheus.GaugeVec
 	unspentCoinCount        *prometheus.GaugeVec
+	confirmedBalanceCoins   *prometheus.GaugeVec
+	spendableBalanceCoins   *prometheus.GaugeVec
+	maxSendAmountCoins      *prometheus.GaugeVec
+
+	// Wallet Info Metrics
+	// walletInfoLabels are the type and asset names walletInfo was last set with, by fingerprint and wallet id, so
+	// the previous series can be removed when a name changes
+	walletInfo       *prometheus.GaugeVec
+	walletInfoLock   sync.Mutex
+	walletInfoLabels map[string][]string
+
+	// Farmed Amount Metrics
+	farmedAmount       *wrappedPrometheus.LazyGauge
+	poolRewardAmount   *wrappedPrometheus.LazyGauge
+	farmerRewardAmount *wrappedPrometheus.LazyGauge
+	feeAmount          *wrappedPrometheus.LazyGauge
+	blocksWon          *wrappedPrometheus.LazyGauge
+	lastHeightFarmed   *wrappedPrometheus.LazyGauge
+
+	// Transaction Metrics
+	transactions             transactionTracker
+	pendingTransactions      *prometheus.GaugeVec
+	pendingTransactionAmount *prometheus.GaugeVec
+	oldestPendingTransaction *prometheus.GaugeVec
+	transactionStuck         *prometheus.GaugeVec
+	transactionsConfirmed    *prometheus.CounterVec
+
+	// Key Metrics
+	// keySwitch is held while other keys are logged in to, so nothing else relies on which key is logged in
+	// keySwitching is set while a key other than the original may be logged in, so websocket events are ignored
+	keySwitch             sync.Mutex
+	keySwitching          int32
+	keySynced             *prometheus.GaugeVec
+	keyLastRefresh        *prometheus.GaugeVec
+	keyFarmedAmount       *prometheus.GaugeVec
+	keyPoolRewardAmount   *prometheus.GaugeVec
+	keyFarmerRewardAmount *prometheus.GaugeVec
+	keyFeeAmount          *prometheus.GaugeVec
+	keyLastHeightFarmed   *prometheus.GaugeVec
+	keyBalance            *prometheus.GaugeVec
+	keyUnspentCoinCount   *prometheus.GaugeVec
+
+	// Coin Metrics
+	// coinFingerprint is the key the coin metrics are for, coinWallets are the wallets they are reported for, and
+	// coinAssetIDs are the asset ids of CAT wallets. These are only used by RefreshCoins
+	coinFingerprint           string
+	coinWallets               map[uint32]bool
+	coinAssetIDs              map[uint32]string
+	spendableCoinAmount       *wrappedPrometheus.SnapshotHistogramVec
+	spendableCoins            *prometheus.GaugeVec
+	dustCoins                 *prometheus.GaugeVec
+	dustAmount                *prometheus.GaugeVec
+	transactionsToSendBalance *prometheus.GaugeVec
+}
+
+// getFarmedAmountResponse is the response from get_farmed_amount on the wallet
+type getFarmedAmountResponse struct {
+	Success            bool    `json:"success"`
+	FarmedAmount       uint64  `json:"farmed_amount"`
+	PoolRewardAmount   uint64  `json:"pool_reward_amount"`
+	FarmerRewardAmount uint64  `json:"farmer_reward_amount"`
+	FeeAmount          uint64  `json:"fee_amount"`
+	LastHeightFarmed   uint32  `json:"last_height_farmed"`
+	BlocksWon          *uint32 `json:"blocks_won"`
 }
 
 // InitMetrics sets all the metrics properties
 func (s *WalletServiceMetrics) InitMetrics() {
 	// Wallet Metrics
 	s.walletSynced = s.metrics.newGauge(staiServiceWallet, "synced", "")
+	s.walletNames = map[uint32]string{}
 	walletLabels := []string{"fingerprint", "wallet_id", "wallet_type", "asset_id"}
 	s.confirmedBalance = s.metrics.newGaugeVec(staiServiceWallet, "confirmed_balance", "", walletLabels)
 	s.spendableBalance = s.metrics.newGaugeVec(staiServiceWallet, "spendable_balance", "", walletLabels)
 	s.maxSendAmount = s.metrics.newGaugeVec(staiServiceWallet, "max_send_amount", "", walletLabels)
 	s.pendingCoinRemovalCount = s.metrics.newGaugeVec(staiServiceWallet, "pending_coin_removal_count", "", walletLabels)
 	s.unspentCoinCount = s.metrics.newGaugeVec(staiServiceWallet, "unspent_coin_count", "", walletLabels)
+	s.confirmedBalanceCoins = s.metrics.newGaugeVec(staiServiceWallet, "confirmed_balance_coins", "Confirmed balance in whole coins, using the precision of the asset held by the wallet", walletLabels)
+	s.spendableBalanceCoins = s.metrics.newGaugeVec(staiServiceWallet, "spendable_balance_coins", "Spendable balance in whole coins, using the precision of the asset held by the wallet", walletLabels)
+	s.maxSendAmountCoins = s.metrics.newGaugeVec(staiServiceWallet, "max_send_amount_coins", "Max send amount in whole coins, using the precision of the asset held by the wallet", walletLabels)
+
+	// Wallet Info Metrics
+	s.walletInfo = s.metrics.newGaugeVec(staiServiceWallet, "wallet_info", "Names of the type of the wallet and the asset it holds. Value is always 1", []string{"fingerprint", "wallet_id", "wallet_type_name", "asset_name"})
+	s.walletInfoLabels = map[string][]string{}
+
+	// Farmed Amount Metrics
+	s.farmedAmount = s.metrics.newGauge(staiServiceWallet, "farmed_amount", "Total amount farmed by this wallet, in mojos")
+	s.poolRewardAmount = s.metrics.newGauge(staiServiceWallet, "pool_reward_amount", "Total pool rewards farmed by this wallet, in mojos")
+	s.farmerRewardAmount = s.metrics.newGauge(staiServiceWallet, "farmer_reward_amount", "Total farmer rewards farmed by this wallet, in mojos")
+	s.feeAmount = s.metrics.newGauge(staiServiceWallet, "fee_amount", "Total fees collected from farmed blocks by this wallet, in mojos")
+	s.blocksWon = s.metrics.newGauge(staiServiceWallet, "blocks_won", "Number of blocks won by this wallet. Only available on versions of STAI that report blocks won")
+	s.lastHeightFarmed = s.metrics.newGauge(staiServiceWallet, "last_height_farmed", "Height of the last block farmed by this wallet")
+
+	// Transaction Metrics
+	s.initTransactionMetrics()
+
+	// Key Metrics
+	s.initKeyMetrics()
+
+	// Coin Metrics
+	s.initCoinMetrics()
 }
 
 // InitialData is called on startup of the metrics server, to allow seeding metrics with
@@ -47,16 +184,56 @@ func (s *WalletServiceMetrics) InitMetrics() {
 func (s *WalletServiceMetrics) InitialData() {
 	utils.LogErr(s.metrics.client.WalletService.GetWallets())
 	utils.LogErr(s.metrics.client.WalletService.GetSyncStatus())
+	utils.LogErr(nil, nil, s.metrics.websocketRequest(rpcinterface.ServiceWallet, "get_farmed_amount", nil))
 }
 
 // Disconnected clears/unregisters metrics when the connection drops
 func (s *WalletServiceMetrics) Disconnected() {
+	s.walletNamesLock.Lock()
+	s.walletNames = map[uint32]string{}
+	s.walletNamesLock.Unlock()
+
 	s.walletSynced.Unregister()
 	s.confirmedBalance.Reset()
 	s.spendableBalance.Reset()
 	s.maxSendAmount.Reset()
 	s.pendingCoinRemovalCount.Reset()
 	s.unspentCoinCount.Reset()
+	s.confirmedBalanceCoins.Reset()
+	s.spendableBalanceCoins.Reset()
+	s.maxSendAmountCoins.Reset()
+
+	s.walletInfoLock.Lock()
+	s.walletInfo.Reset()
+	s.walletInfoLabels = map[string][]string{}
+	s.walletInfoLock.Unlock()
+
+	s.farmedAmount.Unregister()
+	s.poolRewardAmount.Unregister()
+	s.farmerRewardAmount.Unregister()
+	s.feeAmount.Unregister()
+	s.blocksWon.Unregister()
+	s.lastHeightFarmed.Unregister()
+
+	s.resetTransactionMetrics()
+	s.resetKeyMetrics()
+	s.resetCoinMetrics()
+}
+
+// StartBackgroundTasks polls the wallet for pending transactions and spendable coins, and the full node for the
+// balances of other keys, on the configured intervals
+func (s *WalletServiceMetrics) StartBackgroundTasks() {
+	startPolling(viper.GetDuration("wallet-transaction-interval"), s.RefreshTransactions)
+	startPolling(viper.GetDuration("wallet-coin-interval"), s.RefreshCoins)
+	s.watchKeys()
+	if len(viper.GetStringSlice("wallet-fingerprints")) > 0 {
+		if viper.GetBool("wallet-key-switching") {
+			log.Warnln("wallet-key-switching is enabled. The wallet will be logged in to other keys, which affects every client of the wallet")
+			startPolling(viper.GetDuration("wallet-key-interval"), s.RefreshKeys)
+		} else {
+			log.Warnln("wallet-fingerprints is ignored unless wallet-key-switching is enabled. Use wallet-keys to report balances from the full node instead")
+		}
+	}
 }
 
 // Reconnected is called when the service is reconnected after the websocket was disconnected
@@ -77,6 +254,10 @@ func (s *WalletServiceMetrics) ReceiveResponse(resp *types.WebsocketResponse) {
 		s.GetWalletBalance(resp)
 	case "get_wallets":
 		s.GetWallets(resp)
+	case "get_farmed_amount":
+		s.GetFarmedAmount(resp)
+	case "state_changed":
+		s.StateChanged(resp)
 	}
 }
 
@@ -89,14 +270,27 @@ func (s *WalletServiceMetrics) CoinAdded(resp *types.WebsocketResponse) {
 		return
 	}
 
-	utils.LogErr(s.metrics.client.WalletService.GetWalletBalance(&rpc.GetWalletBalanceOptions{WalletID: coinAdded.WalletID}))
-	utils.LogErr(s.metrics.client.WalletService.GetSyncStatus())
+	s.metrics.scheduler.Request("get_wallet_balance", fmt.Sprintf("get_wallet_balance:%d", coinAdded.WalletID), func() error {
+		_, _, err := s.metrics.client.WalletService.GetWalletBalance(&rpc.GetWalletBalanceOptions{WalletID: coinAdded.WalletID})
+		return err
+	})
+	s.requestSyncStatus()
+	// Farming rewards show up as new coins
+	utils.LogErr(nil, nil, s.metrics.websocketRequest(rpcinterface.ServiceWallet, "get_farmed_amount", nil))
 }
 
 // SyncChanged handles the sync_changed event from the websocket
 func (s *WalletServiceMetrics) SyncChanged(resp *types.WebsocketResponse) {
-	// @TODO probably should throttle this call in case we're in a longer sync
-	utils.LogErr(s.metrics.client.WalletService.GetSyncStatus())
+	s.requestSyncStatus()
+}
+
+// requestSyncStatus asks for the sync status, which is throttled since events that trigger it are frequent during
+// a longer sync
+func (s *WalletServiceMetrics) requestSyncStatus() {
+	s.metrics.scheduler.Request("get_sync_status", "get_sync_status", func() error {
+		_, _, err := s.metrics.client.WalletService.GetSyncStatus()
+		return err
+	})
 }
 
 // GetSyncStatus sync status for the wallet
@@ -107,6 +301,10 @@ func (s *WalletServiceMetrics) GetSyncStatus(resp *types.WebsocketResponse) {
 		log.Errorf("Error unmarshalling: %s\n", err.Error())
 		return
 	}
+	if s.switchingKeys() {
+		// The status is for another key, which is reported in key_synced
+		return
+	}
 
 	if syncStatusResponse.Synced {
 		s.walletSynced.Set(1)
@@ -125,26 +323,91 @@ func (s *WalletServiceMetrics) GetWalletBalance(resp *types.WebsocketResponse) {
 	}
 
 	if walletBalance.Balance != nil {
-		fingerprint := fmt.Sprintf("%d", walletBalance.Balance.Fingerprint)
-		walletID := fmt.Sprintf("%d", walletBalance.Balance.WalletID)
-		walletType := ""
-		if walletBalance.Balance.WalletType != nil {
-			walletType = fmt.Sprintf("%d", *walletBalance.Balance.WalletType)
-		}
-		assetID := walletBalance.Balance.AssetID
+		s.ProcessWalletBalance(walletBalance.Balance, s.walletName(uint32(walletBalance.Balance.WalletID)))
+	}
+}
 
-		if walletBalance.Balance.ConfirmedWalletBalance.FitsInUint64() {
-			s.confirmedBalance.WithLabelValues(fingerprint, walletID, walletType, assetID).Set(float64(walletBalance.Balance.ConfirmedWalletBalance.Uint64()))
-		}
+// ProcessWalletBalance updates the balance metrics for a single wallet
+func (s *WalletServiceMetrics) ProcessWalletBalance(balance *types.WalletBalance, walletName string) {
+	fingerprint := fmt.Sprintf("%d", balance.Fingerprint)
+	walletID := fmt.Sprintf("%d", balance.WalletID)
+	walletType := ""
+	typeName := ""
+	decimals := walletDecimals(types.WalletTypeStandard)
+	if balance.WalletType != nil {
+		walletType = fmt.Sprintf("%d", *balance.WalletType)
+		typeName = walletTypeName(*balance.WalletType)
+		decimals = walletDecimals(*balance.WalletType)
+	}
+	assetID := balance.AssetID
+	labels := []string{fingerprint, walletID, walletType, assetID}
+	divisor := math.Pow10(decimals)
+
+	s.setWalletInfo(fingerprint, walletID, typeName, assetName(assetID, walletName))
+
+	if balance.ConfirmedWalletBalance.FitsInUint64() {
+		confirmed := float64(balance.ConfirmedWalletBalance.Uint64())
+		s.confirmedBalance.WithLabelValues(labels...).Set(confirmed)
+		s.confirmedBalanceCoins.WithLabelValues(labels...).Set(confirmed / divisor)
+	}
+
+	if balance.SpendableBalance.FitsInUint64() {
+		spendable := float64(balance.SpendableBalance.Uint64())
+		s.spendableBalance.WithLabelValues(labels...).Set(spendable)
+		s.spendableBalanceCoins.WithLabelValues(labels...).Set(spendable / divisor)
+	}
+
+	s.maxSendAmount.WithLabelValues(labels...).Set(float64(balance.MaxSendAmount))
+	s.maxSendAmountCoins.WithLabelValues(labels...).Set(float64(balance.MaxSendAmount) / divisor)
+	s.pendingCoinRemovalCount.WithLabelValues(labels...).Set(float64(balance.PendingCoinRemovalCount))
+	s.unspentCoinCount.WithLabelValues(labels...).Set(float64(balance.UnspentCoinCount))
+}
 
-		if walletBalance.Balance.SpendableBalance.FitsInUint64() {
-			s.spendableBalance.WithLabelValues(fingerprint, walletID, walletType, assetID).Set(float64(walletBalance.Balance.SpendableBalance.Uint64()))
+// setWalletInfo sets the wallet info metric for a wallet, and removes the previous series if the type or asset name
+// changed, such as when the name of the wallet wasn't known yet
+func (s *WalletServiceMetrics) setWalletInfo(fingerprint string, walletID string, typeName string, assetName string) {
+	labels := []string{fingerprint, walletID, typeName, assetName}
+	key := fingerprint + ":" + walletID
+
+	s.walletInfoLock.Lock()
+	defer s.walletInfoLock.Unlock()
+	if previous, ok := s.walletInfoLabels[key]; ok {
+		if previous[2] == typeName && previous[3] == assetName {
+			return
 		}
+		s.walletInfo.DeleteLabelValues(previous...)
+	}
+	s.walletInfo.WithLabelValues(labels...).Set(1)
+	s.walletInfoLabels[key] = labels
+}
 
-		s.maxSendAmount.WithLabelValues(fingerprint, walletID, walletType, assetID).Set(float64(walletBalance.Balance.MaxSendAmount))
-		s.pendingCoinRemovalCount.WithLabelValues(fingerprint, walletID, walletType, assetID).Set(float64(walletBalance.Balance.PendingCoinRemovalCount))
-		s.unspentCoinCount.WithLabelValues(fingerprint, walletID, walletType, assetID).Set(float64(walletBalance.Balance.UnspentCoinCount))
+// assetName returns the name of the asset held by a wallet. Names configured in asset-names take priority over the
+// name of the wallet
+func assetName(assetID string, walletName string) string {
+	if assetID == "" {
+		return nativeAssetName
+	}
+	if name, ok := viper.GetStringMapString("asset-names")[strings.ToLower(assetID)]; ok {
+		return name
 	}
+	return walletName
+}
+
+// walletName returns the name of a wallet for the logged in key. Wallets we don't have a name for yet cause the list
+// of wallets to be requested again
+func (s *WalletServiceMetrics) walletName(walletID uint32) string {
+	s.walletNamesLock.Lock()
+	name, ok := s.walletNames[walletID]
+	if !ok {
+		// Only ask once, in case the wallet isn't included in the response
+		s.walletNames[walletID] = ""
+	}
+	s.walletNamesLock.Unlock()
+
+	if !ok {
+		utils.LogErr(s.metrics.client.WalletService.GetWallets())
+	}
+	return name
 }
 
 // GetWallets handles a response for get_wallets and asks for the balance of each wallet
@@ -156,7 +419,38 @@ func (s *WalletServiceMetrics) GetWallets(resp *types.WebsocketResponse) {
 		return
 	}
 
+	s.walletNamesLock.Lock()
+	for _, wallet := range wallets.Wallets {
+		if wallet != nil {
+			s.walletNames[wallet.ID] = wallet.Name
+		}
+	}
+	s.walletNamesLock.Unlock()
+
 	for _, wallet := range wallets.Wallets {
 		utils.LogErr(s.metrics.client.WalletService.GetWalletBalance(&rpc.GetWalletBalanceOptions{WalletID: wallet.ID}))
 	}
 }
+
+// GetFarmedAmount updates farming reward metrics from the get_farmed_amount response
+func (s *WalletServiceMetrics) GetFarmedAmount(resp *types.WebsocketResponse) {
+	farmed := &getFarmedAmountResponse{}
+	err := json.Unmarshal(resp.Data, farmed)
+	if err != nil {
+		log.Errorf("Error unmarshalling: %s\n", err.Error())
+		return
+	}
+	if s.switchingKeys() {
+		// The amounts are for another key, which are reported in the key_ metrics
+		return
+	}
+
+	s.farmedAmount.Set(float64(farmed.FarmedAmount))
+	s.poolRewardAmount.Set(float64(farmed.PoolRewardAmount))
+	s.farmerRewardAmount.Set(float64(farmed.FarmerRewardAmount))
+	s.feeAmount.Set(float64(farmed.FeeAmount))
+	s.lastHeightFarmed.Set(float64(farmed.LastHeightFarmed))
+	if farmed.BlocksWon != nil {
+		s.blocksWon.Set(float64(*farmed.BlocksWon))
+	}
+}
@@ -0,0 +1,196 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/forks-lab/go-stai-libs/pkg/rpc"
+	"github.com/forks-lab/go-stai-libs/pkg/rpcinterface"
+	"github.com/forks-lab/go-stai-libs/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Metrics about how fragmented the spendable coins in each wallet are, are in this file
+
+// spendableCoinBuckets are the histogram buckets for the amount of each spendable coin, in whole coins
+var spendableCoinBuckets = []float64{1e-9, 1e-8, 1e-7, 1e-6, 1e-5, 1e-4, 1e-3, 1e-2, 0.1, 1, 10, 100, 1000, 10000}
+
+// getSpendableCoinsOptions are the options for get_spendable_coins on the wallet
+type getSpendableCoinsOptions struct {
+	WalletID uint32 `json:"wallet_id"`
+}
+
+// getSpendableCoinsResponse is the response from get_spendable_coins on the wallet
+type getSpendableCoinsResponse struct {
+	Success          bool          `json:"success"`
+	Error            string        `json:"error"`
+	ConfirmedRecords []*coinRecord `json:"confirmed_records"`
+}
+
+// initCoinMetrics sets up the coin fragmentation metrics
+func (s *WalletServiceMetrics) initCoinMetrics() {
+	labels := []string{"fingerprint", "wallet_id"}
+	s.spendableCoinAmount = s.metrics.newSnapshotHistogramVec(staiServiceWallet, "spendable_coin_amount_coins", "Distribution of the amounts of the spendable coins in the wallet, in whole coins", spendableCoinBuckets, labels)
+	s.spendableCoins = s.metrics.newGaugeVec(staiServiceWallet, "spendable_coins", "Number of spendable coins in the wallet, which is the number of coins needed to send the full spendable balance", labels)
+	s.dustCoins = s.metrics.newGaugeVec(staiServiceWallet, "dust_coins", "Number of spendable coins in the wallet smaller than the dust threshold for its asset", labels)
+	s.dustAmount = s.metrics.newGaugeVec(staiServiceWallet, "dust_amount", "Total amount of the spendable coins in the wallet smaller than the dust threshold for its asset, in mojos of the asset", labels)
+	s.transactionsToSendBalance = s.metrics.newGaugeVec(staiServiceWallet, "transactions_to_send_balance", "Number of transactions needed to send the full spendable balance, given the wallet-max-send-quantity coins that fit in one transaction", labels)
+}
+
+// resetCoinMetrics clears the coin fragmentation metrics
+func (s *WalletServiceMetrics) resetCoinMetrics() {
+	s.spendableCoinAmount.Reset()
+	s.spendableCoins.Reset()
+	s.dustCoins.Reset()
+	s.dustAmount.Reset()
+	s.transactionsToSendBalance.Reset()
+}
+
+// RefreshCoins asks the wallet for the spendable coins in each wallet that holds STAI or a CAT
+func (s *WalletServiceMetrics) RefreshCoins() {
+	s.keySwitch.Lock()
+	defer s.keySwitch.Unlock()
+
+	fingerprint := &getLoggedInFingerprintResponse{}
+	err := s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_logged_in_fingerprint", nil, fingerprint)
+	if err != nil {
+		log.Debugf("Could not get logged in fingerprint from wallet: %s\n", err.Error())
+		return
+	}
+	wallets := &rpc.GetWalletsResponse{}
+	err = s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_wallets", nil, wallets)
+	if err != nil {
+		log.Debugf("Could not get wallets from wallet: %s\n", err.Error())
+		return
+	}
+
+	fingerprintLabel := fmt.Sprintf("%d", fingerprint.Fingerprint)
+	if s.coinFingerprint != fingerprintLabel {
+		// A different key was logged in, so the metrics are for another wallet
+		s.resetCoinMetrics()
+		s.coinFingerprint = fingerprintLabel
+		s.coinWallets = map[uint32]bool{}
+		s.coinAssetIDs = map[uint32]string{}
+	}
+
+	current := map[uint32]bool{}
+	for _, wallet := range wallets.Wallets {
+		if wallet == nil || wallet.Type == nil {
+			continue
+		}
+		if *wallet.Type != types.WalletTypeStandard && *wallet.Type != types.WalletTypeCAT {
+			continue
+		}
+		current[wallet.ID] = true
+
+		coins := &getSpendableCoinsResponse{}
+		err = s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_spendable_coins", &getSpendableCoinsOptions{WalletID: wallet.ID}, coins)
+		if err != nil {
+			log.Debugf("Could not get spendable coins for wallet %d: %s\n", wallet.ID, err.Error())
+			continue
+		}
+		if !coins.Success {
+			log.Debugf("Wallet could not get spendable coins for wallet %d: %s\n", wallet.ID, coins.Error)
+			continue
+		}
+
+		dustThreshold, hasThreshold := s.dustThreshold(wallet.ID, *wallet.Type)
+		s.ProcessSpendableCoins(fingerprintLabel, wallet.ID, *wallet.Type, coins.ConfirmedRecords, dustThreshold, hasThreshold)
+	}
+
+	// Stop reporting wallets that no longer exist
+	for walletID := range s.coinWallets {
+		if current[walletID] {
+			continue
+		}
+		walletIDLabel := fmt.Sprintf("%d", walletID)
+		s.spendableCoinAmount.Delete(fingerprintLabel, walletIDLabel)
+		s.spendableCoins.DeleteLabelValues(fingerprintLabel, walletIDLabel)
+		s.dustCoins.DeleteLabelValues(fingerprintLabel, walletIDLabel)
+		s.dustAmount.DeleteLabelValues(fingerprintLabel, walletIDLabel)
+		s.transactionsToSendBalance.DeleteLabelValues(fingerprintLabel, walletIDLabel)
+		delete(s.coinAssetIDs, walletID)
+	}
+	s.coinWallets = current
+}
+
+// dustThreshold returns the amount, in mojos of the asset held by the wallet, that smaller coins are counted as dust
+// below. STAI uses wallet-dust-threshold, and CATs use the threshold for their asset id in wallet-cat-dust-thresholds.
+// Returns false if there is no threshold for the asset
+func (s *WalletServiceMetrics) dustThreshold(walletID uint32, walletType types.WalletType) (uint64, bool) {
+	if walletType != types.WalletTypeCAT {
+		return viper.GetUint64("wallet-dust-threshold"), true
+	}
+
+	thresholds := viper.GetStringMapString("wallet-cat-dust-thresholds")
+	if len(thresholds) == 0 {
+		return 0, false
+	}
+
+	assetID, ok := s.coinAssetIDs[walletID]
+	if !ok {
+		// The asset id of a wallet doesn't change, so it is only asked for once
+		balance := &rpc.GetWalletBalanceResponse{}
+		err := s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_wallet_balance", &rpc.GetWalletBalanceOptions{WalletID: walletID}, balance)
+		if err != nil || balance.Balance == nil {
+			if err != nil {
+				log.Debugf("Could not get asset id for wallet %d: %s\n", walletID, err.Error())
+			}
+			return 0, false
+		}
+		assetID = balance.Balance.AssetID
+		s.coinAssetIDs[walletID] = assetID
+	}
+
+	configured, ok := thresholds[strings.ToLower(assetID)]
+	if !ok {
+		return 0, false
+	}
+	threshold, err := strconv.ParseUint(configured, 10, 64)
+	if err != nil {
+		log.Errorf("Invalid threshold for %s in wallet-cat-dust-thresholds: %s\n", assetID, configured)
+		return 0, false
+	}
+	return threshold, true
+}
+
+// ProcessSpendableCoins updates the coin fragmentation metrics for a single wallet. Coins are compared to
+// dustThreshold in mojos of the asset, and dust is only reported if hasThreshold is set
+func (s *WalletServiceMetrics) ProcessSpendableCoins(fingerprint string, walletID uint32, walletType types.WalletType, records []*coinRecord, dustThreshold uint64, hasThreshold bool) {
+	divisor := math.Pow10(walletDecimals(walletType))
+
+	var amounts []float64
+	dustCoins := 0
+	dustAmount := uint64(0)
+	for _, record := range records {
+		if record == nil {
+			continue
+		}
+		amount := record.Coin.Amount.Uint64()
+		amounts = append(amounts, float64(amount)/divisor)
+		if amount < dustThreshold {
+			dustCoins++
+			dustAmount += amount
+		}
+	}
+
+	transactions := 0
+	if maxSendQuantity := viper.GetInt("wallet-max-send-quantity"); maxSendQuantity > 0 {
+		transactions = (len(amounts) + maxSendQuantity - 1) / maxSendQuantity
+	}
+
+	walletIDLabel := fmt.Sprintf("%d", walletID)
+	s.spendableCoinAmount.Set(amounts, fingerprint, walletIDLabel)
+	s.spendableCoins.WithLabelValues(fingerprint, walletIDLabel).Set(float64(len(amounts)))
+	if hasThreshold {
+		s.dustCoins.WithLabelValues(fingerprint, walletIDLabel).Set(float64(dustCoins))
+		s.dustAmount.WithLabelValues(fingerprint, walletIDLabel).Set(float64(dustAmount))
+	} else {
+		s.dustCoins.DeleteLabelValues(fingerprint, walletIDLabel)
+		s.dustAmount.DeleteLabelValues(fingerprint, walletIDLabel)
+	}
+	s.transactionsToSendBalance.WithLabelValues(fingerprint, walletIDLabel).Set(float64(transactions))
+}
@@ -0,0 +1,373 @@
+package metrics
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/forks-lab/go-stai-libs/pkg/rpc"
+	"github.com/forks-lab/go-stai-libs/pkg/rpcinterface"
+	"github.com/forks-lab/go-stai-libs/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Metrics for keys other than the one the wallet is logged in to are in this file
+// By default, balances are read from the full node's coin records for the addresses configured for each key in
+// wallet-keys, which never touches the wallet. With wallet-key-switching, each key in wallet-fingerprints is instead
+// logged in to in turn and the original key is logged in to again afterwards. This changes the active key for every
+// other client of the wallet, so it is off by default
+
+// keySyncPollInterval is how often the wallet is checked for sync status after logging in to a key
+const keySyncPollInterval = 5 * time.Second
+
+// allWalletKeys is the value of wallet-fingerprints that monitors every key in the keychain
+const allWalletKeys = "all"
+
+// logInOptions are the options for log_in on the wallet
+// Type skip logs in without asking to restore a backup, on versions of the wallet that support backups
+type logInOptions struct {
+	Fingerprint uint32 `json:"fingerprint"`
+	Type        string `json:"type"`
+}
+
+// logInResponse is the response from log_in on the wallet
+type logInResponse struct {
+	Success     bool   `json:"success"`
+	Error       string `json:"error"`
+	Fingerprint uint32 `json:"fingerprint"`
+}
+
+// walletKey is a key to report the balance of from the full node, without logging the wallet in to it
+type walletKey struct {
+	Fingerprint uint32 `mapstructure:"fingerprint"`
+
+	// Addresses are bech32m addresses or hex puzzle hashes of the key's standard wallet
+	Addresses []string `mapstructure:"addresses"`
+
+	puzzleHashes []string
+}
+
+// coinRecordsByPuzzleHashesOptions are the options for get_coin_records_by_puzzle_hashes on the full node
+type coinRecordsByPuzzleHashesOptions struct {
+	PuzzleHashes      []string `json:"puzzle_hashes"`
+	IncludeSpentCoins bool     `json:"include_spent_coins"`
+}
+
+// getPublicKeysResponse is the response from get_public_keys on the wallet
+type getPublicKeysResponse struct {
+	Success               bool     `json:"success"`
+	PublicKeyFingerprints []uint32 `json:"public_key_fingerprints"`
+}
+
+// initKeyMetrics sets up the metrics reported for each monitored key
+func (s *WalletServiceMetrics) initKeyMetrics() {
+	labels := []string{"fingerprint"}
+	s.keySynced = s.metrics.newGaugeVec(staiServiceWallet, "key_synced", "Indicates the wallet was synced for the key when its balances were last collected", labels)
+	s.keyLastRefresh = s.metrics.newGaugeVec(staiServiceWallet, "key_last_refresh_timestamp", "Time the balances for the key were last collected, as a unix timestamp", labels)
+	s.keyFarmedAmount = s.metrics.newGaugeVec(staiServiceWallet, "key_farmed_amount", "Total amount farmed by the key, in mojos", labels)
+	s.keyPoolRewardAmount = s.metrics.newGaugeVec(staiServiceWallet, "key_pool_reward_amount", "Total pool rewards farmed by the key, in mojos", labels)
+	s.keyFarmerRewardAmount = s.metrics.newGaugeVec(staiServiceWallet, "key_farmer_reward_amount", "Total farmer rewards farmed by the key, in mojos", labels)
+	s.keyFeeAmount = s.metrics.newGaugeVec(staiServiceWallet, "key_fee_amount", "Total fees collected from farmed blocks by the key, in mojos", labels)
+	s.keyLastHeightFarmed = s.metrics.newGaugeVec(staiServiceWallet, "key_last_height_farmed", "Height of the last block farmed by the key", labels)
+	s.keyBalance = s.metrics.newGaugeVec(staiServiceWallet, "key_balance", "Total amount of the unspent coins at the addresses configured for the key in wallet-keys, in mojos", labels)
+	s.keyUnspentCoinCount = s.metrics.newGaugeVec(staiServiceWallet, "key_unspent_coin_count", "Number of unspent coins at the addresses configured for the key in wallet-keys", labels)
+}
+
+// resetKeyMetrics clears the metrics for each monitored key
+func (s *WalletServiceMetrics) resetKeyMetrics() {
+	s.keySynced.Reset()
+	s.keyLastRefresh.Reset()
+	s.keyFarmedAmount.Reset()
+	s.keyPoolRewardAmount.Reset()
+	s.keyFarmerRewardAmount.Reset()
+	s.keyFeeAmount.Reset()
+	s.keyLastHeightFarmed.Reset()
+	s.keyBalance.Reset()
+	s.keyUnspentCoinCount.Reset()
+}
+
+// watchKeys reads the keys from the wallet-keys config and starts refreshing their balances from the full node
+func (s *WalletServiceMetrics) watchKeys() {
+	var configured []*walletKey
+	err := viper.UnmarshalKey("wallet-keys", &configured)
+	if err != nil {
+		log.Errorf("Error reading wallet-keys config: %s\n", err.Error())
+		return
+	}
+
+	var keys []*walletKey
+	for _, key := range configured {
+		if key == nil || key.Fingerprint == 0 {
+			continue
+		}
+		for _, address := range key.Addresses {
+			puzzleHash, err := parsePuzzleHash(address)
+			if err != nil {
+				log.Errorf("Invalid address %s for key %d: %s\n", address, key.Fingerprint, err.Error())
+				continue
+			}
+			key.puzzleHashes = append(key.puzzleHashes, puzzleHash)
+		}
+		if len(key.puzzleHashes) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	startPolling(viper.GetDuration("wallet-key-interval"), func() {
+		for _, key := range keys {
+			s.RefreshKeyBalance(key)
+		}
+	})
+}
+
+// RefreshKeyBalance asks the full node for the unspent coins at the addresses of a key and updates its balance
+func (s *WalletServiceMetrics) RefreshKeyBalance(key *walletKey) {
+	records := &coinRecordsResponse{}
+	err := s.metrics.httpRequest(rpcinterface.ServiceFullNode, "get_coin_records_by_puzzle_hashes", &coinRecordsByPuzzleHashesOptions{PuzzleHashes: key.puzzleHashes}, records)
+	if err != nil {
+		log.Debugf("Could not get coin records for key %d from full node: %s\n", key.Fingerprint, err.Error())
+		return
+	}
+	if !records.Success {
+		log.Debugf("Full node could not get coin records for key %d: %s\n", key.Fingerprint, records.Error)
+		return
+	}
+
+	balance := 0.0
+	unspent := 0
+	for _, record := range records.CoinRecords {
+		if record == nil {
+			continue
+		}
+		balance += float64(record.Coin.Amount.Uint64())
+		unspent++
+	}
+
+	fingerprintLabel := fmt.Sprintf("%d", key.Fingerprint)
+	s.keyBalance.WithLabelValues(fingerprintLabel).Set(balance)
+	s.keyUnspentCoinCount.WithLabelValues(fingerprintLabel).Set(float64(unspent))
+	s.keyLastRefresh.WithLabelValues(fingerprintLabel).Set(float64(time.Now().Unix()))
+}
+
+// switchingKeys returns true while a key other than the original one may be logged in
+func (s *WalletServiceMetrics) switchingKeys() bool {
+	return atomic.LoadInt32(&s.keySwitching) == 1
+}
+
+// RefreshKeys collects balances, sync status, and farmed amounts for every key in wallet-fingerprints by logging the
+// wallet in to each one, which is only done when wallet-key-switching is enabled. Keys are only switched when the
+// logged in key is synced and has no pending transactions, so switching can't interrupt anything the wallet is doing
+// for it
+func (s *WalletServiceMetrics) RefreshKeys() {
+	s.keySwitch.Lock()
+	defer s.keySwitch.Unlock()
+
+	loggedIn := &getLoggedInFingerprintResponse{}
+	err := s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_logged_in_fingerprint", nil, loggedIn)
+	if err != nil {
+		log.Debugf("Could not get logged in fingerprint from wallet: %s\n", err.Error())
+		return
+	}
+	original := loggedIn.Fingerprint
+	if original == 0 {
+		log.Debugln("Wallet is not logged in to a key, skipping key refresh")
+		return
+	}
+
+	fingerprints, err := s.monitoredKeys()
+	if err != nil {
+		log.Debugf("Could not get keys from wallet: %s\n", err.Error())
+		return
+	}
+
+	synced := s.collectKey(original)
+	if !synced {
+		log.Infof("Wallet is not synced for key %d, not switching to other keys\n", original)
+		return
+	}
+	if s.hasPendingTransactions() {
+		log.Infof("Key %d has pending transactions, not switching to other keys\n", original)
+		return
+	}
+
+	atomic.StoreInt32(&s.keySwitching, 1)
+	defer s.restoreKey(original)
+
+	for _, fingerprint := range fingerprints {
+		if fingerprint == original {
+			continue
+		}
+		err = s.logIn(fingerprint)
+		if err != nil {
+			log.Errorf("Error logging in to key %d: %s\n", fingerprint, err.Error())
+			continue
+		}
+		if !s.waitForSync(fingerprint) {
+			log.Infof("Wallet did not sync key %d within %s, skipping balances\n", fingerprint, viper.GetDuration("wallet-key-sync-timeout"))
+			s.keySynced.WithLabelValues(fmt.Sprintf("%d", fingerprint)).Set(0)
+			continue
+		}
+		s.collectKey(fingerprint)
+	}
+}
+
+// monitoredKeys returns the fingerprints configured in wallet-fingerprints, or every key in the keychain for "all"
+func (s *WalletServiceMetrics) monitoredKeys() ([]uint32, error) {
+	var fingerprints []uint32
+	for _, configured := range viper.GetStringSlice("wallet-fingerprints") {
+		configured = strings.TrimSpace(configured)
+		if strings.EqualFold(configured, allWalletKeys) {
+			keys := &getPublicKeysResponse{}
+			err := s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_public_keys", nil, keys)
+			if err != nil {
+				return nil, err
+			}
+			return keys.PublicKeyFingerprints, nil
+		}
+
+		fingerprint, err := strconv.ParseUint(configured, 10, 32)
+		if err != nil {
+			log.Errorf("Invalid fingerprint in wallet-fingerprints: %s\n", configured)
+			continue
+		}
+		fingerprints = append(fingerprints, uint32(fingerprint))
+	}
+	return fingerprints, nil
+}
+
+// hasPendingTransactions returns true if the logged in key has transactions that have not been confirmed
+func (s *WalletServiceMetrics) hasPendingTransactions() bool {
+	wallets := &rpc.GetWalletsResponse{}
+	err := s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_wallets", nil, wallets)
+	if err != nil {
+		// Can't tell, so assume there are
+		return true
+	}
+
+	pending := map[string]*types.TransactionRecord{}
+	for _, wallet := range wallets.Wallets {
+		if wallet == nil {
+			continue
+		}
+		err = s.fetchPendingTransactions(wallet.ID, pending)
+		if err != nil {
+			return true
+		}
+	}
+	return len(pending) > 0
+}
+
+// logIn logs the wallet in to a key, without restoring from a backup
+func (s *WalletServiceMetrics) logIn(fingerprint uint32) error {
+	log.Debugf("Logging wallet in to key %d\n", fingerprint)
+
+	// Wallet names are for the logged in key, so they need to be fetched again for the new key
+	s.walletNamesLock.Lock()
+	s.walletNames = map[uint32]string{}
+	s.walletNamesLock.Unlock()
+
+	resp := &logInResponse{}
+	err := s.metrics.httpRequest(rpcinterface.ServiceWallet, "log_in", &logInOptions{Fingerprint: fingerprint, Type: "skip"}, resp)
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	return nil
+}
+
+// restoreKey logs the wallet back in to the key that was logged in before switching, and refreshes the metrics for it
+func (s *WalletServiceMetrics) restoreKey(original uint32) {
+	loggedIn := &getLoggedInFingerprintResponse{}
+	err := s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_logged_in_fingerprint", nil, loggedIn)
+	if err != nil || loggedIn.Fingerprint != original {
+		err = s.logIn(original)
+		if err != nil {
+			log.Errorf("Error logging wallet back in to key %d: %s\n", original, err.Error())
+		}
+	}
+
+	// Responses to these requests are for the original key again
+	atomic.StoreInt32(&s.keySwitching, 0)
+	s.InitialData()
+}
+
+// waitForSync waits for the wallet to report it is synced, up to wallet-key-sync-timeout
+func (s *WalletServiceMetrics) waitForSync(fingerprint uint32) bool {
+	deadline := time.Now().Add(viper.GetDuration("wallet-key-sync-timeout"))
+	for {
+		syncStatus := &rpc.GetWalletSyncStatusResponse{}
+		err := s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_sync_status", nil, syncStatus)
+		if err != nil {
+			log.Debugf("Could not get sync status for key %d: %s\n", fingerprint, err.Error())
+		} else if syncStatus.Synced {
+			return true
+		}
+
+		if time.Now().Add(keySyncPollInterval).After(deadline) {
+			return false
+		}
+		time.Sleep(keySyncPollInterval)
+	}
+}
+
+// collectKey updates the balances, sync status, and farmed amounts for the logged in key, and returns whether the
+// wallet is synced for it
+func (s *WalletServiceMetrics) collectKey(fingerprint uint32) bool {
+	fingerprintLabel := fmt.Sprintf("%d", fingerprint)
+
+	syncStatus := &rpc.GetWalletSyncStatusResponse{}
+	err := s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_sync_status", nil, syncStatus)
+	if err != nil {
+		log.Debugf("Could not get sync status for key %d: %s\n", fingerprint, err.Error())
+		return false
+	}
+	if !syncStatus.Synced {
+		s.keySynced.WithLabelValues(fingerprintLabel).Set(0)
+		return false
+	}
+	s.keySynced.WithLabelValues(fingerprintLabel).Set(1)
+
+	wallets := &rpc.GetWalletsResponse{}
+	err = s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_wallets", nil, wallets)
+	if err != nil {
+		log.Debugf("Could not get wallets for key %d: %s\n", fingerprint, err.Error())
+		return true
+	}
+	for _, wallet := range wallets.Wallets {
+		if wallet == nil {
+			continue
+		}
+		balance := &rpc.GetWalletBalanceResponse{}
+		err = s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_wallet_balance", &rpc.GetWalletBalanceOptions{WalletID: wallet.ID}, balance)
+		if err != nil {
+			log.Debugf("Could not get balance of wallet %d for key %d: %s\n", wallet.ID, fingerprint, err.Error())
+			continue
+		}
+		if balance.Balance != nil {
+			s.ProcessWalletBalance(balance.Balance, wallet.Name)
+		}
+	}
+
+	farmed := &getFarmedAmountResponse{}
+	err = s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_farmed_amount", nil, farmed)
+	if err != nil {
+		log.Debugf("Could not get farmed amount for key %d: %s\n", fingerprint, err.Error())
+	} else {
+		s.keyFarmedAmount.WithLabelValues(fingerprintLabel).Set(float64(farmed.FarmedAmount))
+		s.keyPoolRewardAmount.WithLabelValues(fingerprintLabel).Set(float64(farmed.PoolRewardAmount))
+		s.keyFarmerRewardAmount.WithLabelValues(fingerprintLabel).Set(float64(farmed.FarmerRewardAmount))
+		s.keyFeeAmount.WithLabelValues(fingerprintLabel).Set(float64(farmed.FeeAmount))
+		s.keyLastHeightFarmed.WithLabelValues(fingerprintLabel).Set(float64(farmed.LastHeightFarmed))
+	}
+
+	s.keyLastRefresh.WithLabelValues(fingerprintLabel).Set(float64(time.Now().Unix()))
+	return true
+}
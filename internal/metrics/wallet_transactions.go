@@ -0,0 +1,414 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/forks-lab/go-stai-libs/pkg/rpc"
+	"github.com/forks-lab/go-stai-libs/pkg/rpcinterface"
+	"github.com/forks-lab/go-stai-libs/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Metrics about pending wallet transactions are in this file
+
+const (
+	// walletTransactionPageSize is the number of transactions requested at a time from get_transactions
+	walletTransactionPageSize = 100
+
+	// targetBlockTime is the average time between blocks, used to estimate the height of transactions that were
+	// already pending when the exporter started
+	targetBlockTime = 18.75
+
+	// transactionCheckAttempts is the number of polls a transaction that is no longer pending is checked for, when the
+	// wallet can't say whether it was confirmed, before it stops being tracked
+	transactionCheckAttempts = 5
+)
+
+// getTransactionsOptions are the options for get_transactions on the wallet
+// Sorting by confirmed height returns pending transactions, which have a height of 0, first
+type getTransactionsOptions struct {
+	WalletID uint32 `json:"wallet_id"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+	SortKey  string `json:"sort_key"`
+	Reverse  bool   `json:"reverse"`
+}
+
+// getTransactionOptions are the options for get_transaction on the wallet
+type getTransactionOptions struct {
+	TransactionID string `json:"transaction_id"`
+}
+
+// getTransactionResponse is the response from get_transaction on the wallet
+type getTransactionResponse struct {
+	Success     bool                     `json:"success"`
+	Error       string                   `json:"error"`
+	Transaction *types.TransactionRecord `json:"transaction"`
+}
+
+// getHeightInfoResponse is the response from get_height_info on the wallet
+type getHeightInfoResponse struct {
+	Success bool   `json:"success"`
+	Height  uint32 `json:"height"`
+}
+
+// getLoggedInFingerprintResponse is the response from get_logged_in_fingerprint on the wallet
+type getLoggedInFingerprintResponse struct {
+	Success     bool   `json:"success"`
+	Fingerprint uint32 `json:"fingerprint"`
+}
+
+// walletStateChangedEvent is the data from state_changed events sent by the wallet to the wallet UI
+type walletStateChangedEvent struct {
+	State          string `json:"state"`
+	WalletID       uint32 `json:"wallet_id"`
+	AdditionalData struct {
+		Transaction *types.TransactionRecord `json:"transaction"`
+	} `json:"additional_data"`
+}
+
+// pendingTransaction is a transaction that has not been confirmed yet
+type pendingTransaction struct {
+	walletID      uint32
+	amount        uint64
+	createdAt     uint64
+	createdHeight uint32
+	stuck         bool
+
+	// checkFailures is the number of times the wallet couldn't say whether the transaction was confirmed, after it
+	// was no longer pending
+	checkFailures int
+}
+
+// transactionTracker holds the pending transactions for the logged in key
+// Updated from the polling goroutine and websocket events, so protected by lock
+type transactionTracker struct {
+	lock        sync.Mutex
+	fingerprint string
+	height      uint32
+	wallets     []uint32
+	pending     map[string]*pendingTransaction
+}
+
+// initTransactionMetrics sets up the wallet transaction metrics
+func (s *WalletServiceMetrics) initTransactionMetrics() {
+	s.transactions.pending = map[string]*pendingTransaction{}
+
+	labels := []string{"fingerprint", "wallet_id"}
+	s.pendingTransactions = s.metrics.newGaugeVec(staiServiceWallet, "pending_transactions", "Number of transactions that have not been confirmed", labels)
+	s.pendingTransactionAmount = s.metrics.newGaugeVec(staiServiceWallet, "pending_transaction_amount", "Total amount of the transactions that have not been confirmed, in mojos", labels)
+	s.oldestPendingTransaction = s.metrics.newGaugeVec(staiServiceWallet, "oldest_pending_transaction_age_seconds", "Time since the oldest transaction that has not been confirmed was created, in seconds", labels)
+	s.transactionStuck = s.metrics.newGaugeVec(staiServiceWallet, "transaction_stuck", "Indicates a transaction has not been confirmed after wallet-stuck-transaction-blocks blocks", labels)
+	s.transactionsConfirmed = s.metrics.newCounterVec(staiServiceWallet, "transactions_confirmed_total", "Number of pending transactions that were confirmed since the exporter was started", labels)
+}
+
+// resetTransactionMetrics clears the pending transaction metrics
+func (s *WalletServiceMetrics) resetTransactionMetrics() {
+	s.transactions.lock.Lock()
+	s.transactions.pending = map[string]*pendingTransaction{}
+	s.transactions.lock.Unlock()
+
+	s.pendingTransactions.Reset()
+	s.pendingTransactionAmount.Reset()
+	s.oldestPendingTransaction.Reset()
+	s.transactionStuck.Reset()
+}
+
+// RefreshTransactions asks the wallet for the pending transactions in every wallet
+func (s *WalletServiceMetrics) RefreshTransactions() {
+	s.keySwitch.Lock()
+	defer s.keySwitch.Unlock()
+
+	fingerprint := &getLoggedInFingerprintResponse{}
+	err := s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_logged_in_fingerprint", nil, fingerprint)
+	if err != nil {
+		log.Debugf("Could not get logged in fingerprint from wallet: %s\n", err.Error())
+		return
+	}
+	height := &getHeightInfoResponse{}
+	err = s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_height_info", nil, height)
+	if err != nil {
+		log.Debugf("Could not get height from wallet: %s\n", err.Error())
+		return
+	}
+	wallets := &rpc.GetWalletsResponse{}
+	err = s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_wallets", nil, wallets)
+	if err != nil {
+		log.Debugf("Could not get wallets from wallet: %s\n", err.Error())
+		return
+	}
+
+	pending := map[string]*types.TransactionRecord{}
+	var walletIDs []uint32
+	for _, wallet := range wallets.Wallets {
+		if wallet == nil {
+			continue
+		}
+		walletIDs = append(walletIDs, wallet.ID)
+		err = s.fetchPendingTransactions(wallet.ID, pending)
+		if err != nil {
+			log.Debugf("Could not get transactions for wallet %d: %s\n", wallet.ID, err.Error())
+			return
+		}
+	}
+
+	s.ProcessPendingTransactions(fmt.Sprintf("%d", fingerprint.Fingerprint), height.Height, walletIDs, pending)
+}
+
+// fetchPendingTransactions adds the pending transactions for a wallet to pending
+func (s *WalletServiceMetrics) fetchPendingTransactions(walletID uint32, pending map[string]*types.TransactionRecord) error {
+	for start := 0; ; start += walletTransactionPageSize {
+		transactions := &rpc.GetWalletTransactionsResponse{}
+		err := s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_transactions", &getTransactionsOptions{
+			WalletID: walletID,
+			Start:    start,
+			End:      start + walletTransactionPageSize,
+			SortKey:  "CONFIRMED_AT_HEIGHT",
+		}, transactions)
+		if err != nil {
+			return err
+		}
+
+		for _, transaction := range transactions.Transactions {
+			if transaction == nil {
+				continue
+			}
+			if transaction.Confirmed {
+				// Pending transactions are sorted first, so there are no more
+				return nil
+			}
+			pending[transaction.Name] = transaction
+		}
+
+		if len(transactions.Transactions) < walletTransactionPageSize {
+			return nil
+		}
+	}
+}
+
+// ProcessPendingTransactions replaces the tracked pending transactions with the ones currently pending in the wallet
+// Transactions that are no longer pending are checked to see if they were confirmed or removed
+func (s *WalletServiceMetrics) ProcessPendingTransactions(fingerprint string, height uint32, walletIDs []uint32, pending map[string]*types.TransactionRecord) {
+	t := &s.transactions
+	t.lock.Lock()
+	if t.fingerprint != fingerprint {
+		// A different key was logged in, so the tracked transactions are for another wallet
+		t.pending = map[string]*pendingTransaction{}
+		s.pendingTransactions.Reset()
+		s.pendingTransactionAmount.Reset()
+		s.oldestPendingTransaction.Reset()
+		s.transactionStuck.Reset()
+	}
+	t.fingerprint = fingerprint
+	t.height = height
+
+	// Stop reporting wallets that no longer exist
+	current := map[uint32]bool{}
+	for _, walletID := range walletIDs {
+		current[walletID] = true
+	}
+	for _, walletID := range t.wallets {
+		if current[walletID] {
+			continue
+		}
+		walletIDLabel := fmt.Sprintf("%d", walletID)
+		s.pendingTransactions.DeleteLabelValues(fingerprint, walletIDLabel)
+		s.pendingTransactionAmount.DeleteLabelValues(fingerprint, walletIDLabel)
+		s.oldestPendingTransaction.DeleteLabelValues(fingerprint, walletIDLabel)
+		s.transactionStuck.DeleteLabelValues(fingerprint, walletIDLabel)
+		s.transactionsConfirmed.DeleteLabelValues(fingerprint, walletIDLabel)
+	}
+	t.wallets = walletIDs
+
+	var gone []string
+	for name := range t.pending {
+		if _, ok := pending[name]; !ok {
+			gone = append(gone, name)
+		}
+	}
+	for name, transaction := range pending {
+		if _, ok := t.pending[name]; !ok {
+			t.pending[name] = s.newPendingTransaction(transaction, height)
+		}
+	}
+	t.lock.Unlock()
+
+	for _, name := range gone {
+		transaction := &getTransactionResponse{}
+		err := s.metrics.httpRequest(rpcinterface.ServiceWallet, "get_transaction", &getTransactionOptions{TransactionID: name}, transaction)
+		if err == nil && !transaction.Success {
+			err = fmt.Errorf("%s", transaction.Error)
+		}
+		switch {
+		case err != nil:
+			// Keep tracking the transaction and check again on the next poll, so it isn't missed if it was confirmed
+			log.Debugf("Could not get wallet transaction %s: %s\n", name, err.Error())
+			s.transactionCheckFailed(name)
+		case transaction.Transaction != nil && transaction.Transaction.Confirmed:
+			s.transactionConfirmed(name)
+		default:
+			s.transactionRemoved(name)
+		}
+	}
+
+	s.updateTransactionMetrics()
+}
+
+// newPendingTransaction returns the tracking data for a transaction that was not pending before
+// The height the transaction was created at isn't available, so transactions older than the current block have
+// their height estimated from their age
+func (s *WalletServiceMetrics) newPendingTransaction(transaction *types.TransactionRecord, height uint32) *pendingTransaction {
+	createdHeight := height
+	age := time.Now().Unix() - int64(transaction.CreatedAtTime)
+	if age > 0 && transaction.CreatedAtTime > 0 {
+		blocks := uint32(float64(age) / targetBlockTime)
+		if blocks < height {
+			createdHeight = height - blocks
+		} else {
+			createdHeight = 0
+		}
+	}
+
+	return &pendingTransaction{
+		walletID:      transaction.WalletID,
+		amount:        transaction.Amount,
+		createdAt:     transaction.CreatedAtTime,
+		createdHeight: createdHeight,
+	}
+}
+
+// transactionConfirmed counts a pending transaction as confirmed and stops tracking it
+func (s *WalletServiceMetrics) transactionConfirmed(name string) {
+	t := &s.transactions
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	transaction, ok := t.pending[name]
+	if !ok {
+		return
+	}
+	delete(t.pending, name)
+	s.transactionsConfirmed.WithLabelValues(t.fingerprint, fmt.Sprintf("%d", transaction.walletID)).Inc()
+	if transaction.stuck {
+		log.Infof("Wallet transaction %s confirmed after being stuck\n", name)
+	}
+}
+
+// transactionRemoved stops tracking a pending transaction that was removed from the wallet without confirming
+func (s *WalletServiceMetrics) transactionRemoved(name string) {
+	t := &s.transactions
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.pending, name)
+}
+
+// transactionCheckFailed records that the wallet couldn't say whether a transaction that is no longer pending was
+// confirmed, and stops tracking it after transactionCheckAttempts polls
+func (s *WalletServiceMetrics) transactionCheckFailed(name string) {
+	t := &s.transactions
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	transaction, ok := t.pending[name]
+	if !ok {
+		return
+	}
+	transaction.checkFailures++
+	if transaction.checkFailures >= transactionCheckAttempts {
+		log.Infof("Could not tell if wallet transaction %s was confirmed after %d attempts, no longer tracking it\n", name, transaction.checkFailures)
+		delete(t.pending, name)
+	}
+}
+
+// TransactionUpdated handles tx_update events for a single transaction
+func (s *WalletServiceMetrics) TransactionUpdated(transaction *types.TransactionRecord) {
+	if transaction == nil || transaction.Name == "" {
+		return
+	}
+
+	if transaction.Confirmed {
+		s.transactionConfirmed(transaction.Name)
+	} else {
+		t := &s.transactions
+		t.lock.Lock()
+		if _, ok := t.pending[transaction.Name]; !ok && t.fingerprint != "" {
+			t.pending[transaction.Name] = s.newPendingTransaction(transaction, t.height)
+		}
+		t.lock.Unlock()
+	}
+
+	s.updateTransactionMetrics()
+}
+
+// StateChanged handles state_changed events the wallet sends to the wallet UI. Only transaction updates are used
+func (s *WalletServiceMetrics) StateChanged(resp *types.WebsocketResponse) {
+	event := &walletStateChangedEvent{}
+	err := json.Unmarshal(resp.Data, event)
+	if err != nil {
+		log.Errorf("Error unmarshalling: %s\n", err.Error())
+		return
+	}
+	if s.switchingKeys() {
+		// Transactions are only tracked for the original key
+		return
+	}
+
+	if event.State == "tx_update" {
+		s.TransactionUpdated(event.AdditionalData.Transaction)
+	}
+}
+
+// updateTransactionMetrics sets the pending transaction metrics from the tracked transactions
+func (s *WalletServiceMetrics) updateTransactionMetrics() {
+	t := &s.transactions
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.fingerprint == "" {
+		return
+	}
+
+	stuckBlocks := uint32(viper.GetInt("wallet-stuck-transaction-blocks"))
+	now := time.Now().Unix()
+
+	count := map[uint32]int{}
+	amount := map[uint32]uint64{}
+	oldest := map[uint32]uint64{}
+	stuck := map[uint32]bool{}
+	for name, transaction := range t.pending {
+		count[transaction.walletID]++
+		amount[transaction.walletID] += transaction.amount
+		if transaction.createdAt > 0 && (oldest[transaction.walletID] == 0 || transaction.createdAt < oldest[transaction.walletID]) {
+			oldest[transaction.walletID] = transaction.createdAt
+		}
+
+		if stuckBlocks > 0 && t.height >= transaction.createdHeight && t.height-transaction.createdHeight >= stuckBlocks {
+			stuck[transaction.walletID] = true
+			if !transaction.stuck {
+				transaction.stuck = true
+				log.Warnf("Wallet transaction %s in wallet %d has not confirmed after %d blocks\n", name, transaction.walletID, t.height-transaction.createdHeight)
+			}
+		}
+	}
+
+	for _, walletID := range t.wallets {
+		walletIDLabel := fmt.Sprintf("%d", walletID)
+		s.pendingTransactions.WithLabelValues(t.fingerprint, walletIDLabel).Set(float64(count[walletID]))
+		s.pendingTransactionAmount.WithLabelValues(t.fingerprint, walletIDLabel).Set(float64(amount[walletID]))
+		if oldest[walletID] > 0 && now > int64(oldest[walletID]) {
+			s.oldestPendingTransaction.WithLabelValues(t.fingerprint, walletIDLabel).Set(float64(now - int64(oldest[walletID])))
+		} else {
+			s.oldestPendingTransaction.WithLabelValues(t.fingerprint, walletIDLabel).Set(0)
+		}
+		if stuck[walletID] {
+			s.transactionStuck.WithLabelValues(t.fingerprint, walletIDLabel).Set(1)
+		} else {
+			s.transactionStuck.WithLabelValues(t.fingerprint, walletIDLabel).Set(0)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package prometheus
 
 import (
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -11,11 +13,15 @@ type LazyCounter struct {
 	Counter  prometheus.Counter
 	Registry *prometheus.Registry
 
+	// Some metrics are updated from background tasks as well as websocket handlers
+	lock       sync.Mutex
 	registered bool
 }
 
 // Inc wraps prometheus.Counter.Inc with a call to MustRegister
 func (l *LazyCounter) Inc() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	if !l.registered {
 		l.registered = true
 		l.Registry.MustRegister(l.Counter)
@@ -26,6 +32,8 @@ func (l *LazyCounter) Inc() {
 
 // Add wraps prometheus.Counter.Add with a call to MustRegister
 func (l *LazyCounter) Add(val float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	if !l.registered {
 		l.registered = true
 		l.Registry.MustRegister(l.Counter)
@@ -36,6 +44,8 @@ func (l *LazyCounter) Add(val float64) {
 
 // Unregister removes the metric from the Registry to stop reporting it until it is registered again
 func (l *LazyCounter) Unregister() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	if l.registered {
 		l.registered = false
 		l.Registry.Unregister(l.Counter)
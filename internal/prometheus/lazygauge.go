@@ -1,6 +1,8 @@
 package prometheus
 
 import (
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -11,11 +13,15 @@ type LazyGauge struct {
 	Gauge    prometheus.Gauge
 	Registry *prometheus.Registry
 
+	// Some metrics are updated from background tasks as well as websocket handlers
+	lock       sync.Mutex
 	registered bool
 }
 
 // Set wraps prometheus.Set with a call to MustRegister
 func (l *LazyGauge) Set(val float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	if !l.registered {
 		l.registered = true
 		l.Registry.MustRegister(l.Gauge)
@@ -26,6 +32,8 @@ func (l *LazyGauge) Set(val float64) {
 
 // Unregister removes the metric from the Registry to stop reporting it until it is registered again
 func (l *LazyGauge) Unregister() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	if l.registered {
 		l.registered = false
 		l.Registry.Unregister(l.Gauge)
@@ -0,0 +1,154 @@
+package prometheus
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SnapshotHistogram is a histogram of a set of values that is replaced on every update, rather than accumulating
+// observations over time. This is useful for the distribution of something that is fetched periodically as a whole,
+// such as the items in the mempool. Like LazyGauge, it doesn't register itself until Set is called
+type SnapshotHistogram struct {
+	Desc     *prometheus.Desc
+	Buckets  []float64
+	Registry *prometheus.Registry
+
+	lock       sync.Mutex
+	registered bool
+	snapshot   snapshot
+}
+
+// snapshot holds the bucket counts for one set of values
+type snapshot struct {
+	count  uint64
+	sum    float64
+	counts map[float64]uint64
+}
+
+// set replaces the values in the snapshot
+func (s *snapshot) set(buckets []float64, values []float64) {
+	s.count = uint64(len(values))
+	s.sum = 0
+	s.counts = make(map[float64]uint64, len(buckets))
+	for _, bucket := range buckets {
+		s.counts[bucket] = 0
+	}
+	for _, value := range values {
+		s.sum += value
+		for _, bucket := range buckets {
+			if value <= bucket {
+				s.counts[bucket]++
+			}
+		}
+	}
+}
+
+// metric returns a const histogram of the snapshot
+func (s *snapshot) metric(desc *prometheus.Desc, labelValues ...string) prometheus.Metric {
+	counts := make(map[float64]uint64, len(s.counts))
+	for bucket, count := range s.counts {
+		counts[bucket] = count
+	}
+	return prometheus.MustNewConstHistogram(desc, s.count, s.sum, counts, labelValues...)
+}
+
+// Set replaces the values in the histogram, and registers the histogram if necessary
+func (h *SnapshotHistogram) Set(values []float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.registered {
+		h.registered = true
+		h.Registry.MustRegister(h)
+	}
+
+	h.snapshot.set(h.Buckets, values)
+}
+
+// Unregister removes the metric from the Registry to stop reporting it until it is registered again
+func (h *SnapshotHistogram) Unregister() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.registered {
+		h.registered = false
+		h.Registry.Unregister(h)
+	}
+}
+
+// Describe implements prometheus.Collector
+func (h *SnapshotHistogram) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.Desc
+}
+
+// Collect implements prometheus.Collector
+func (h *SnapshotHistogram) Collect(ch chan<- prometheus.Metric) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ch <- h.snapshot.metric(h.Desc)
+}
+
+// SnapshotHistogramVec is a SnapshotHistogram partitioned by labels, such as one distribution per wallet
+// Like GaugeVec, it is registered when created and only reports the label values that have been set
+type SnapshotHistogramVec struct {
+	Desc    *prometheus.Desc
+	Buckets []float64
+
+	lock      sync.Mutex
+	snapshots map[string]*snapshot
+	labels    map[string][]string
+}
+
+// Set replaces the values in the histogram for the label values
+func (h *SnapshotHistogramVec) Set(values []float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.snapshots == nil {
+		h.snapshots = map[string]*snapshot{}
+		h.labels = map[string][]string{}
+	}
+
+	key := strings.Join(labelValues, "\x00")
+	s, ok := h.snapshots[key]
+	if !ok {
+		s = &snapshot{}
+		h.snapshots[key] = s
+		h.labels[key] = labelValues
+	}
+	s.set(h.Buckets, values)
+}
+
+// Delete stops reporting the histogram for the label values
+func (h *SnapshotHistogramVec) Delete(labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	key := strings.Join(labelValues, "\x00")
+	delete(h.snapshots, key)
+	delete(h.labels, key)
+}
+
+// Reset stops reporting the histogram for all label values
+func (h *SnapshotHistogramVec) Reset() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.snapshots = nil
+	h.labels = nil
+}
+
+// Describe implements prometheus.Collector
+func (h *SnapshotHistogramVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.Desc
+}
+
+// Collect implements prometheus.Collector
+func (h *SnapshotHistogramVec) Collect(ch chan<- prometheus.Metric) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for key, s := range h.snapshots {
+		ch <- s.metric(h.Desc, h.labels[key]...)
+	}
+}